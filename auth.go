@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// errors
+var (
+	ErrReadingKeyFile = errors.New("error reading key file")
+	ErrParsingKey     = errors.New("error parsing key")
+	ErrReadingKeyDir  = errors.New("error reading key directory")
+	ErrNoKeysFound    = errors.New("no usable keys found")
+	ErrCertificate    = errors.New("error loading certificate")
+	ErrNoAuth         = errors.New("no authentication configured")
+)
+
+// ParseKeyFile reads a private key from path.  If the key is encrypted prompt
+// is called to get the passphrase, so you are only asked for a passphrase
+// when it is needed.  If prompt is nil encrypted keys are rejected.
+func ParseKeyFile(path string, prompt func() ([]byte, error)) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrReadingKeyFile, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) || prompt == nil {
+		return nil, fmt.Errorf("%w [%s]: %v", ErrParsingKey, path, err)
+	}
+
+	passphrase, err := prompt()
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: %v", ErrParsingKey, path, err)
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: %v", ErrParsingKey, path, err)
+	}
+	return signer, nil
+}
+
+// ParseKeyDir parses every private key in dir.  Files ending in .pub and files
+// that can't be parsed as private keys (including encrypted keys that
+// passphrase doesn't unlock) are skipped.  We only return an error if dir
+// can't be read or if it contains no usable keys.
+func ParseKeyDir(dir string, passphrase []byte) ([]ssh.Signer, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrReadingKeyDir, err)
+	}
+
+	prompt := func() ([]byte, error) { return passphrase, nil }
+	if passphrase == nil {
+		prompt = nil
+	}
+
+	var signers []ssh.Signer
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".pub") {
+			continue
+		}
+
+		signer, err := ParseKeyFile(filepath.Join(dir, entry.Name()), prompt)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("%w in [%s]", ErrNoKeysFound, dir)
+	}
+	return signers, nil
+}
+
+// ParseCertificateFile reads the SSH user certificate in certPath (typically
+// something like id_ed25519-cert.pub) and returns a signer that presents the
+// certificate and signs with signer, which must hold the certified key.
+func ParseCertificateFile(certPath string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCertificate, err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: %v", ErrCertificate, certPath, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w [%s]: not a certificate", ErrCertificate, certPath)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: %v", ErrCertificate, certPath, err)
+	}
+	return certSigner, nil
+}
+
+// agentSocketPath returns the path of the ssh-agent socket: socket, which is
+// the AgentSocket from the config, or SSH_AUTH_SOCK if socket is empty.
+func agentSocketPath(socket string) string {
+	if socket != "" {
+		return socket
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// openAgent connects to the ssh-agent and returns the agent client along with
+// the connection to the agent, which the caller must close.  If no agent socket
+// is configured but we have other signers we do without the agent and return
+// nil.
+//
+// We fail with ErrNoAuth if there is neither an agent socket nor any signers,
+// or if the agent holds no keys and there are no other signers, rather than
+// failing with a less obvious error when connecting to the first hop.  If we
+// can't connect to the agent we fail with ErrOpeningAuthSock, unless the
+// socket came from SSH_AUTH_SOCK and we have other signers.  A stale
+// SSH_AUTH_SOCK inherited by a container or a tmux session is common, and
+// shouldn't stop us from using the keys we were given.
+func openAgent(c Config) (agent.ExtendedAgent, net.Conn, error) {
+	path := agentSocketPath(c.AgentSocket)
+	if path == "" {
+		if len(c.Signers) > 0 {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("%w: no signers given and neither AgentSocket nor SSH_AUTH_SOCK is set", ErrNoAuth)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		if c.AgentSocket == "" && len(c.Signers) > 0 {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("%w [%s]: %v", ErrOpeningAuthSock, path, err)
+	}
+	agentClient := agent.NewClient(conn)
+
+	if len(c.Signers) == 0 {
+		keys, err := agentClient.List()
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("%w [%s]: %v", ErrConnectAgent, path, err)
+		}
+		if len(keys) == 0 {
+			conn.Close()
+			return nil, nil, fmt.Errorf("%w: no signers given and the ssh-agent on [%s] holds no keys", ErrNoAuth, path)
+		}
+	}
+	return agentClient, conn, nil
+}
+
+// AuthMethodsSummary describes the credentials the tunnel authenticates with,
+// one entry per source of keys.  This is useful when troubleshooting
+// authentication failures.
+func (t *Tunnel) AuthMethodsSummary() []string {
+	var summary []string
+
+	if n := len(t.configSigners()); n > 0 {
+		summary = append(summary, fmt.Sprintf("publickey: %d signers from config", n))
+	}
+
+	if t.agentClient != nil {
+		summary = append(summary, fmt.Sprintf("publickey: ssh-agent on [%s]", agentSocketPath(t.config.AgentSocket)))
+	}
+	return summary
+}
+
+// SetSigners replaces the signers from the config.  Hops we are already
+// connected to are not affected, the new signers are used the next time a
+// hop is connected, eg. after Reset.  This lets you rotate short lived
+// certificates without creating a new tunnel.
+func (t *Tunnel) SetSigners(signers ...ssh.Signer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config.Signers = append([]ssh.Signer(nil), signers...)
+}
+
+// configSigners returns a copy of the signers from the config.
+func (t *Tunnel) configSigners() []ssh.Signer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]ssh.Signer(nil), t.config.Signers...)
+}
+
+// DebugAuth is like AuthMethodsSummary, but also asks the ssh-agent how many
+// keys it currently holds, since they can come and go after the tunnel was
+// created.  It doesn't connect to any of the hops.
+func (t *Tunnel) DebugAuth() ([]string, error) {
+	var summary []string
+
+	if n := len(t.configSigners()); n > 0 {
+		summary = append(summary, fmt.Sprintf("publickey: %d signers from config", n))
+	}
+
+	if t.agentClient != nil {
+		path := agentSocketPath(t.config.AgentSocket)
+
+		keys, err := t.agentClient.List()
+		if err != nil {
+			return summary, fmt.Errorf("%w [%s]: %v", ErrConnectAgent, path, err)
+		}
+		summary = append(summary, fmt.Sprintf("publickey: ssh-agent on [%s] holds %d keys", path, len(keys)))
+	}
+	return summary, nil
+}
+
+// signers returns the signers we offer when authenticating: the ones from the
+// config followed by the ones in the ssh-agent.  They have to be offered by a
+// single auth method since x/crypto/ssh only tries each method type once.  If
+// the agent fails we go on with the signers from the config if there are any.
+func (t *Tunnel) signers() ([]ssh.Signer, error) {
+	signers := t.configSigners()
+
+	if t.agentClient != nil {
+		agentSigners, err := t.agentClient.Signers()
+		if err != nil {
+			// an agent that went away shouldn't stop us from using the
+			// keys we were given
+			if len(signers) > 0 {
+				return signers, nil
+			}
+			return nil, err
+		}
+		signers = append(signers, agentSigners...)
+	}
+	return signers, nil
+}
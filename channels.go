@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// acquireClient returns the client on the last hop that we should open the
+// next channel on, along with the path of its chain and a function that must
+// be called once the channel is closed.  If MaxSessionsPerHop is set we pick
+// the connection with the fewest open channels, and if they are all full we
+// connect another one.  Only one extra connection is made at a time; other
+// callers wait for it and then pick again.
+func (t *Tunnel) acquireClient(ctx context.Context) (*ssh.Client, []Hop, func(), error) {
+	limit := t.config.MaxSessionsPerHop
+
+	t.mu.Lock()
+	if t.closed {
+		err := t.errClosed()
+		t.mu.Unlock()
+		return nil, nil, nil, err
+	}
+
+	if limit <= 0 {
+		last, path := t.last, t.path
+		t.mu.Unlock()
+		return last, path, func() {}, nil
+	}
+
+	client := t.last
+	for _, c := range t.extra {
+		if t.channels[c] < t.channels[client] {
+			client = c
+		}
+	}
+
+	if t.channels[client] >= limit {
+		if t.connecting != nil {
+			connecting := t.connecting
+			t.mu.Unlock()
+
+			select {
+			case <-connecting:
+				return t.acquireClient(ctx)
+			case <-ctx.Done():
+				return nil, nil, nil, ctx.Err()
+			}
+		}
+
+		connecting := make(chan struct{})
+		t.connecting = connecting
+		chain := t.clients
+		t.mu.Unlock()
+
+		extra, err := t.connectExtra(ctx, chain)
+
+		t.mu.Lock()
+		if t.connecting == connecting {
+			t.connecting = nil
+		}
+		close(connecting)
+
+		if err != nil {
+			if t.closed {
+				err = t.errClosed()
+			}
+			t.mu.Unlock()
+			return nil, nil, nil, err
+		}
+
+		if t.closed || t.clients[0] != chain[0] {
+			// the tunnel was shut down or reset while we were connecting
+			t.mu.Unlock()
+			extra.Close()
+			return t.acquireClient(ctx)
+		}
+		t.extra = append(t.extra, extra)
+		client = extra
+	}
+
+	t.channels[client]++
+	path := t.path
+	t.mu.Unlock()
+
+	release := sync.OnceFunc(func() {
+		t.mu.Lock()
+		n, ok := t.channels[client]
+		if !ok {
+			t.mu.Unlock()
+			return
+		}
+
+		n--
+		t.channels[client] = n
+		if n > 0 || client == t.last {
+			t.mu.Unlock()
+			return
+		}
+
+		// extra connections are closed once they are idle so a burst of
+		// channels doesn't leave them open for the life of the tunnel
+		delete(t.channels, client)
+		t.extra = slices.DeleteFunc(t.extra, func(c *ssh.Client) bool { return c == client })
+		t.mu.Unlock()
+		client.Close()
+	})
+	return client, path, release, nil
+}
+
+// connectExtra makes another connection to the last hop of chain.  We give up
+// if either ctx is done or the tunnel is shut down.
+func (t *Tunnel) connectExtra(ctx context.Context, chain []*ssh.Client) (*ssh.Client, error) {
+	i := len(t.hops) - 1
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(t.ctx, cancel)
+	defer stop()
+
+	sshDialer := t.sshDial
+	if i > 0 {
+		sshDialer = t.hopDialer(chain[i-1], i)
+	}
+
+	client, _, err := t.connectHop(ctx, i, sshDialer)
+	if err != nil {
+		return nil, &HopError{
+			Index: i,
+			Hop:   t.hops[i],
+			Err:   fmt.Errorf("%w: %w", ErrCreatingConnection, err),
+		}
+	}
+	return client, nil
+}
+
+// closeExtra closes the additional connections to the last hop.
+func (t *Tunnel) closeExtra(extra []*ssh.Client) error {
+	var errs error
+
+	i := len(t.hops) - 1
+	for _, client := range extra {
+		err := client.Close()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%w: hop %d [%s]", ErrClosingHop, i, t.hops[i]))
+		}
+	}
+	return errs
+}
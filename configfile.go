@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errors
+var (
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+// jsonConfig is the schema ConfigFromJSON reads.
+type jsonConfig struct {
+	Hops                  []string       `json:"hops"`
+	ProxyCommands         map[int]string `json:"proxy_commands"`
+	ParallelDial          bool           `json:"parallel_dial"`
+	ClientVersion         string         `json:"client_version"`
+	HopTimeout            duration       `json:"hop_timeout"`
+	ConnectTimeout        duration       `json:"connect_timeout"`
+	FirstHopRetries       int            `json:"first_hop_retries"`
+	FirstHopBackoff       duration       `json:"first_hop_backoff"`
+	FirstHopNetwork       string         `json:"first_hop_network"`
+	TCPKeepAlive          duration       `json:"tcp_keepalive"`
+	StrictHostKeyChecking bool           `json:"strict_host_key_checking"`
+	AcceptNewHostKeys     bool           `json:"accept_new_host_keys"`
+	KnownHostsFiles       []string       `json:"known_hosts_files"`
+	AgentSocket           string         `json:"agent_socket"`
+	KeyFiles              []jsonKeyFile  `json:"key_files"`
+	MaxSessionsPerHop     int            `json:"max_sessions_per_hop"`
+	RejectDuplicateHops   bool           `json:"reject_duplicate_hops"`
+	ListenPortRangeStart  int            `json:"listen_port_range_start"`
+	ListenPortRangeEnd    int            `json:"listen_port_range_end"`
+	RemoteBindAll         bool           `json:"remote_bind_all"`
+}
+
+// jsonKeyFile is a private key file.  The passphrase of an encrypted key is
+// read from the environment variable named by PassphraseEnv so it doesn't
+// have to be stored in the config.
+type jsonKeyFile struct {
+	Path          string `json:"path"`
+	PassphraseEnv string `json:"passphrase_env"`
+}
+
+// duration is a time.Duration that is given as a string like "10s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// ConfigFromJSON creates a Config from a JSON document, so tunnels can be
+// defined without writing Go.  The keys are the Config field names in
+// snake_case, eg. "hops", "hop_timeout" and "known_hosts_files", durations are
+// strings like "10s" and proxy_commands maps hop indexes, as strings, to
+// commands.  Fields that take Go values, like the callbacks, can be set on
+// the returned Config afterwards.
+//
+// Private keys are given as a list of files:
+//
+//	"key_files": [
+//	    {"path": "/etc/tunnel/id_ed25519", "passphrase_env": "TUNNEL_KEY_PASSPHRASE"}
+//	]
+//
+// The passphrase of an encrypted key is read from the environment variable
+// named by passphrase_env, which is only needed if the key is encrypted.
+func ConfigFromJSON(data []byte) (Config, error) {
+	var jc jsonConfig
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&jc)
+	if err != nil {
+		return Config{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	c := Config{
+		Hops:                  jc.Hops,
+		ProxyCommands:         jc.ProxyCommands,
+		ParallelDial:          jc.ParallelDial,
+		ClientVersion:         jc.ClientVersion,
+		HopTimeout:            time.Duration(jc.HopTimeout),
+		ConnectTimeout:        time.Duration(jc.ConnectTimeout),
+		FirstHopRetries:       jc.FirstHopRetries,
+		FirstHopBackoff:       time.Duration(jc.FirstHopBackoff),
+		FirstHopNetwork:       jc.FirstHopNetwork,
+		TCPKeepAlive:          time.Duration(jc.TCPKeepAlive),
+		StrictHostKeyChecking: jc.StrictHostKeyChecking,
+		AcceptNewHostKeys:     jc.AcceptNewHostKeys,
+		KnownHostsFiles:       jc.KnownHostsFiles,
+		AgentSocket:           jc.AgentSocket,
+		MaxSessionsPerHop:     jc.MaxSessionsPerHop,
+		RejectDuplicateHops:   jc.RejectDuplicateHops,
+		ListenPortRangeStart:  jc.ListenPortRangeStart,
+		ListenPortRangeEnd:    jc.ListenPortRangeEnd,
+		RemoteBindAll:         jc.RemoteBindAll,
+	}
+
+	for _, kf := range jc.KeyFiles {
+		var prompt func() ([]byte, error)
+		if kf.PassphraseEnv != "" {
+			prompt = func() ([]byte, error) {
+				passphrase, ok := os.LookupEnv(kf.PassphraseEnv)
+				if !ok {
+					return nil, fmt.Errorf("%s is not set", kf.PassphraseEnv)
+				}
+				return []byte(passphrase), nil
+			}
+		}
+
+		signer, err := ParseKeyFile(kf.Path, prompt)
+		if err != nil {
+			return Config{}, err
+		}
+		c.Signers = append(c.Signers, signer)
+	}
+	return c, nil
+}
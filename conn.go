@@ -0,0 +1,248 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a connection that was dialed through the tunnel and has
+// not been closed yet.
+type ConnInfo struct {
+	// Network and Addr are the arguments the connection was dialed with.
+	Network string
+	Addr    string
+
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// Created is when the connection was made.
+	Created time.Time
+
+	// Tag is the tag the connection was dialed with, see ContextWithTag.
+	Tag string
+
+	// BytesRead and BytesWritten are the number of bytes read from and
+	// written to the connection so far, see Counter.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Counter is implemented by the connections returned by Dial and friends.
+// Type-assert a connection to Counter to get the number of bytes that have
+// been read from and written to it.
+type Counter interface {
+	BytesRead() uint64
+	BytesWritten() uint64
+}
+
+// Pather is implemented by the connections returned by Dial and friends.
+// Path returns the hops the connection runs through, with the address that
+// was used for each hop, which is useful for audit logging.
+type Pather interface {
+	Path() []Hop
+}
+
+// tagKey is the context key for the tag set by ContextWithTag.
+type tagKey struct{}
+
+// ContextWithTag returns a copy of ctx carrying tag.  Connections dialed with
+// the returned context are tagged with tag in ActiveConns, so you can tie
+// them back to eg. the request they were made for.
+func ContextWithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// tunnelConn wraps the connections we get when dialing through the tunnel.
+//
+// The SSH channels underneath do not support deadlines, so tunnelConn emulates
+// them: when a deadline passes the connection is closed, which interrupts any
+// Read or Write that is blocked, and from then on Read and Write fail with
+// os.ErrDeadlineExceeded.  This means that a connection is unusable once a
+// deadline has passed, but it is what most users of deadlines do on a timeout
+// anyway.  Moving or clearing a deadline before it passes works as expected.
+type tunnelConn struct {
+	net.Conn
+
+	network string
+	addr    string
+	created time.Time
+	tag     string
+	path    []Hop
+
+	// onClose is called when the connection is closed
+	onClose func()
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    atomic.Bool
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+var (
+	_ Counter = (*tunnelConn)(nil)
+	_ Pather  = (*tunnelConn)(nil)
+)
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(uint64(n))
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *tunnelConn) BytesRead() uint64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *tunnelConn) BytesWritten() uint64 {
+	return c.bytesWritten.Load()
+}
+
+// Path returns the hops the connection runs through.
+func (c *tunnelConn) Path() []Hop {
+	return slices.Clone(c.path)
+}
+
+// CloseWrite closes the sending side of the connection, which tells the other
+// end that we are done writing while we can still read its response.
+func (c *tunnelConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// Close the connection and stop any pending deadline timers.
+func (c *tunnelConn) Close() error {
+	c.mu.Lock()
+	stopTimer(c.readTimer)
+	stopTimer(c.writeTimer)
+	c.mu.Unlock()
+
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return c.Conn.Close()
+}
+
+// SetDeadline sets both the read and write deadline.
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+// resetTimer stops timer and, unless t is zero, returns a new timer that
+// expires the connection at t.  Must be called with c.mu held.
+func (c *tunnelConn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	stopTimer(timer)
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), c.expire)
+}
+
+func (c *tunnelConn) expire() {
+	c.expired.Store(true)
+	c.Conn.Close()
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// newConn wraps conn, which was dialed to addr with ctx through the hops in
+// path, in a tunnelConn and records it among the active connections of the
+// tunnel until it is closed.  release, if non-nil, is called when the
+// connection is closed.
+func (t *Tunnel) newConn(ctx context.Context, conn net.Conn, network, addr string, path []Hop, release func()) *tunnelConn {
+	tag, _ := ctx.Value(tagKey{}).(string)
+
+	c := &tunnelConn{
+		Conn:    conn,
+		network: network,
+		addr:    addr,
+		created: time.Now(),
+		tag:     tag,
+		path:    slices.Clone(path),
+	}
+
+	c.onClose = sync.OnceFunc(func() {
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+
+		if release != nil {
+			release()
+		}
+	})
+
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	return c
+}
+
+// ActiveConns returns a snapshot of the connections dialed through the tunnel
+// that have not been closed yet.
+func (t *Tunnel) ActiveConns() []ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(t.conns))
+	for c := range t.conns {
+		infos = append(infos, ConnInfo{
+			Network:      c.network,
+			Addr:         c.addr,
+			LocalAddr:    c.LocalAddr(),
+			RemoteAddr:   c.RemoteAddr(),
+			Created:      c.created,
+			Tag:          c.tag,
+			BytesRead:    c.BytesRead(),
+			BytesWritten: c.BytesWritten(),
+		})
+	}
+	return infos
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestActiveConnsReportsBytes(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	tun := newTestTunnel(t, Config{Hops: []string{newTestServer(t, nil)}})
+
+	conn, err := tun.DialContext(context.Background(), "tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := tun.ActiveConns()
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 active connection, got %d", len(infos))
+	}
+	if infos[0].BytesWritten != 4 || infos[0].BytesRead != 2 {
+		t.Fatalf("expected 4 bytes written and 2 read, got %d and %d", infos[0].BytesWritten, infos[0].BytesRead)
+	}
+}
@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errors
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+)
+
+// directTCPIPMsg is the payload of a direct-tcpip channel open request, see
+// RFC 4254 section 7.2.
+type directTCPIPMsg struct {
+	Addr     string
+	Port     uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+// DialWithOrigin works like DialContext for tcp, but lets you set the
+// originator address and port we report to the last hop when opening the
+// channel.  ssh.Client.Dial always reports 0.0.0.0:0, which some servers log or
+// filter on.
+func (t *Tunnel) DialWithOrigin(ctx context.Context, network, addr, origAddr string, origPort uint32) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: [%s], DialWithOrigin only supports tcp, tcp4 and tcp6", ErrUnsupportedNetwork, network)
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+
+	last, path, release, err := t.acquireClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := directTCPIPMsg{
+		Addr:     host,
+		Port:     uint32(port),
+		OrigAddr: origAddr,
+		OrigPort: origPort,
+	}
+
+	conn, err := dialWithContext(ctx, func() (net.Conn, error) {
+		ch, reqs, err := last.OpenChannel("direct-tcpip", ssh.Marshal(&msg))
+		if err != nil {
+			return nil, err
+		}
+		go ssh.DiscardRequests(reqs)
+
+		return &channelConn{
+			Channel: ch,
+			laddr:   &net.TCPAddr{IP: net.ParseIP(origAddr), Port: int(origPort)},
+			raddr:   &net.TCPAddr{IP: net.ParseIP(host), Port: int(port)},
+		}, nil
+	})
+	if err != nil {
+		release()
+		if t.config.OnDialError != nil {
+			t.config.OnDialError(addr, err)
+		}
+		return nil, t.errIfClosed(err)
+	}
+	return t.newConn(ctx, conn, network, addr, path, release), nil
+}
+
+// channelConn makes an SSH channel look like a net.Conn.  Deadlines are not
+// supported here, they are emulated by the tunnelConn wrapping it.
+type channelConn struct {
+	ssh.Channel
+	laddr net.Addr
+	raddr net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *channelConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *channelConn) SetDeadline(time.Time) error      { return errDeadlineNotSupported }
+func (c *channelConn) SetReadDeadline(time.Time) error  { return errDeadlineNotSupported }
+func (c *channelConn) SetWriteDeadline(time.Time) error { return errDeadlineNotSupported }
+
+var errDeadlineNotSupported = errors.New("deadline not supported")
@@ -1,7 +1,8 @@
 // Package tunnel implements a tunnel to another machine from which we can
-// Dial other machines or Listen to remote ports. For now this library won't
-// check host keys (it just accepts all) and for simplicity it assumes that
-// you are using an ssh-agent to access your ssh keys.
+// Dial other machines or Listen to remote ports. Unless you set
+// StrictHostKeyChecking this library won't check host keys (it just accepts
+// all) and for simplicity it assumes that you are using an ssh-agent to
+// access your ssh keys.
 //
 // Typical use:
 //
@@ -2,6 +2,9 @@ module github.com/borud/tunnel
 
 go 1.21.3
 
-require golang.org/x/crypto v0.14.0
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+)
 
 require golang.org/x/sys v0.13.0 // indirect
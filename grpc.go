@@ -0,0 +1,20 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+)
+
+// GRPCDialer returns a dial function for grpc.WithContextDialer that dials
+// through the tunnel over tcp.  Use the passthrough resolver so gRPC hands the
+// address to the dialer unresolved:
+//
+//	conn, err := grpc.Dial("passthrough:///service.example.com:4711",
+//		grpc.WithContextDialer(tunnel.GRPCDialer()),
+//		...
+//	)
+func (t *Tunnel) GRPCDialer() func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return t.DialContext(ctx, "tcp", addr)
+	}
+}
@@ -3,19 +3,34 @@ package tunnel
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
-
-	"golang.org/x/crypto/ssh"
+	"strings"
 )
 
-// hop represents a hop in the tunnel
-type hop struct {
-	username        string
-	host            string
-	port            int
-	sshClientConfig ssh.ClientConfig
-	sshClient       *ssh.Client
+// Hop represents a hop in the tunnel
+type Hop struct {
+	Username string
+	Host     string
+	Port     int
+
+	// Fallbacks is a list of alternative host:port addresses for the hop that
+	// are tried in order if we are unable to connect to Host and Port.
+	Fallbacks []string
+
+	// ProxyCommand, if set, is run on the hop before this one to connect
+	// to this hop, see Config.ProxyCommands.
+	ProxyCommand string
+}
+
+// HopError is returned when we fail to connect to a hop while building the
+// tunnel.  Err wraps the sentinel that describes the failure.
+type HopError struct {
+	Index int
+	Hop   Hop
+	Err   error
 }
 
 // userHostPortRegex matches username@host:port
@@ -24,29 +39,37 @@ var userHostPortRegex = regexp.MustCompile(`^([^@]+)@([^:]+):(\d+)`)
 // errors
 var (
 	ErrInvalidFormat = errors.New("invalid format")
+	ErrDuplicateHop  = errors.New("duplicate hop")
 )
 
+// defaultSSHPort is used for ssh:// URLs that don't specify a port.
+const defaultSSHPort = 22
+
 // parseHops just parses the list of hop specs and returns an array of hop elements.
-func parseHops(userHostPorts []string) ([]hop, error) {
-	var links []hop
+func parseHops(userHostPorts []string) ([]Hop, error) {
+	var links []Hop
 
 	for _, s := range userHostPorts {
+		s, fallbacks, _ := strings.Cut(s, ",")
 
-		uhp := userHostPortRegex.FindStringSubmatch(s)
-		if len(uhp) != 4 {
-			return nil, fmt.Errorf("%w: wrong number of elements in [%s]", ErrInvalidFormat, s)
-		}
-
-		port, err := strconv.ParseInt(uhp[3], 10, 64)
+		link, err := parseHop(s)
 		if err != nil {
-			return nil, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+			return nil, err
 		}
 
-		link := hop{
-			username: uhp[1],
-			host:     uhp[2],
-			port:     int(port),
+		if fallbacks != "" {
+			for _, addr := range strings.Split(fallbacks, ",") {
+				_, p, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, fmt.Errorf("%w: fallback [%s]: %v", ErrInvalidFormat, addr, err)
+				}
+				if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+					return nil, fmt.Errorf("%w: fallback [%s]: %v", ErrInvalidFormat, addr, err)
+				}
+				link.Fallbacks = append(link.Fallbacks, addr)
+			}
 		}
+
 		links = append(links, link)
 
 	}
@@ -54,6 +77,112 @@ func parseHops(userHostPorts []string) ([]hop, error) {
 	return links, nil
 }
 
-func (l hop) String() string {
-	return fmt.Sprintf("%s@%s:%d", l.username, l.host, l.port)
+// checkDuplicateHops returns an error if the same host:port appears more than
+// once in hops, which is almost always a copy-paste mistake.
+func checkDuplicateHops(hops []Hop) error {
+	seen := map[string]int{}
+
+	for i, hop := range hops {
+		addr := hop.addrs()[0]
+		if j, ok := seen[addr]; ok {
+			return fmt.Errorf("%w: hop %d [%s] and hop %d [%s]", ErrDuplicateHop, j, hops[j], i, hop)
+		}
+		seen[addr] = i
+	}
+	return nil
+}
+
+// addrs returns the addresses of the hop in the order they should be tried.
+func (l Hop) addrs() []string {
+	return append([]string{net.JoinHostPort(l.Host, strconv.Itoa(l.Port))}, l.Fallbacks...)
+}
+
+// withAddr returns a copy of the hop that has addr, one of the addresses of
+// the hop, as its host and port and no fallbacks.
+func (l Hop) withAddr(addr string) Hop {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return l
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return l
+	}
+	return Hop{
+		Username:     l.Username,
+		Host:         host,
+		Port:         port,
+		ProxyCommand: l.ProxyCommand,
+	}
+}
+
+// parseHop parses a single hop which is either on the form user@host:port or
+// an ssh://user@host:port URL.  The port is optional in the URL form and
+// defaults to 22.
+func parseHop(s string) (Hop, error) {
+	if strings.HasPrefix(s, "ssh://") {
+		return parseHopURL(s)
+	}
+
+	uhp := userHostPortRegex.FindStringSubmatch(s)
+	if len(uhp) != 4 {
+		return Hop{}, fmt.Errorf("%w: wrong number of elements in [%s]", ErrInvalidFormat, s)
+	}
+
+	port, err := strconv.ParseUint(uhp[3], 10, 16)
+	if err != nil {
+		return Hop{}, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+
+	return Hop{
+		Username: uhp[1],
+		Host:     uhp[2],
+		Port:     int(port),
+	}, nil
+}
+
+func parseHopURL(s string) (Hop, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Hop{}, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return Hop{}, fmt.Errorf("%w: no user in [%s]", ErrInvalidFormat, s)
+	}
+
+	if u.Hostname() == "" {
+		return Hop{}, fmt.Errorf("%w: no host in [%s]", ErrInvalidFormat, s)
+	}
+
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return Hop{}, fmt.Errorf("%w: unexpected path, query or fragment in [%s]", ErrInvalidFormat, s)
+	}
+
+	port := uint64(defaultSSHPort)
+	if u.Port() != "" {
+		port, err = strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return Hop{}, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+	}
+
+	return Hop{
+		Username: u.User.Username(),
+		Host:     u.Hostname(),
+		Port:     int(port),
+	}, nil
+}
+
+func (l Hop) String() string {
+	return l.Username + "@" + net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d [%s]: %v", e.Index, e.Hop, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *HopError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseHop(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Hop
+	}{
+		{"bob@bastion.example.com:22", Hop{Username: "bob", Host: "bastion.example.com", Port: 22}},
+		{"ssh://bob@bastion.example.com", Hop{Username: "bob", Host: "bastion.example.com", Port: 22}},
+		{"ssh://bob@bastion.example.com/", Hop{Username: "bob", Host: "bastion.example.com", Port: 22}},
+		{"ssh://bob@bastion.example.com:2222", Hop{Username: "bob", Host: "bastion.example.com", Port: 2222}},
+		{"ssh://bob@[::1]:2222", Hop{Username: "bob", Host: "::1", Port: 2222}},
+		{"ssh://bob@[::1]", Hop{Username: "bob", Host: "::1", Port: 22}},
+		{"ssh://bob@[2001:db8::1]:22", Hop{Username: "bob", Host: "2001:db8::1", Port: 22}},
+	}
+
+	for _, test := range tests {
+		got, err := parseHop(test.in)
+		if err != nil {
+			t.Errorf("parseHop(%q): unexpected error: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseHop(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseHopInvalid(t *testing.T) {
+	tests := []string{
+		"bastion.example.com:22",
+		"bob@bastion.example.com",
+		"ssh://bastion.example.com",
+		"ssh://bob@",
+		"ssh://bob@bastion.example.com:port",
+		"ssh://bob@bastion.example.com:70000",
+		"bob@bastion.example.com:70000",
+		"ssh://bob@bastion.example.com/path",
+		"ssh://bob@bastion.example.com?query",
+		"ssh://bob@bastion.example.com#fragment",
+	}
+
+	for _, in := range tests {
+		_, err := parseHop(in)
+		if !errors.Is(err, ErrInvalidFormat) {
+			t.Errorf("parseHop(%q): expected ErrInvalidFormat, got %v", in, err)
+		}
+	}
+}
+
+func TestParseHopsMixedForms(t *testing.T) {
+	hops, err := parseHops([]string{
+		"ssh://bob@bastion.example.com",
+		"alice@inside.example.com:2222,[::1]:2222",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Hop{
+		{Username: "bob", Host: "bastion.example.com", Port: 22},
+		{Username: "alice", Host: "inside.example.com", Port: 2222, Fallbacks: []string{"[::1]:2222"}},
+	}
+	if !reflect.DeepEqual(hops, want) {
+		t.Errorf("parseHops = %+v, want %+v", hops, want)
+	}
+}
+
+func TestHopString(t *testing.T) {
+	tests := []struct {
+		hop  Hop
+		want string
+	}{
+		{Hop{Username: "bob", Host: "bastion.example.com", Port: 22}, "bob@bastion.example.com:22"},
+		{Hop{Username: "bob", Host: "::1", Port: 2222}, "bob@[::1]:2222"},
+	}
+
+	for _, test := range tests {
+		if got := test.hop.String(); got != test.want {
+			t.Errorf("%+v.String() = %q, want %q", test.hop, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errors
+var (
+	ErrKnownHosts = errors.New("error reading known_hosts")
+)
+
+// resolveHostKeyCallback returns the callback we use to verify the host keys
+// of the hops.  We verify against KnownHostsFiles and KnownHostsData if
+// either is set, otherwise against ~/.ssh/known_hosts if StrictHostKeyChecking
+// or AcceptNewHostKeys is set, otherwise we accept any host key.  If HostCAs is
+// set we accept host certificates signed by them and only fall back to
+// known_hosts for plain host keys if known_hosts checking is enabled.
+func resolveHostKeyCallback(c Config) (ssh.HostKeyCallback, error) {
+	callback, err := baseHostKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.HostKeyObserver != nil {
+		callback = observeHostKeys(callback, c.HostKeyObserver)
+	}
+	return callback, nil
+}
+
+func baseHostKeyCallback(c Config) (ssh.HostKeyCallback, error) {
+	if len(c.HostCAs) == 0 {
+		return knownHostsCallback(c)
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			for _, ca := range c.HostCAs {
+				if keysEqual(auth, ca) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	if len(c.KnownHostsFiles) > 0 || c.KnownHostsData != nil || c.StrictHostKeyChecking || c.AcceptNewHostKeys {
+		fallback, err := knownHostsCallback(c)
+		if err != nil {
+			return nil, err
+		}
+		checker.HostKeyFallback = fallback
+	}
+	return checker.CheckHostKey, nil
+}
+
+func knownHostsCallback(c Config) (ssh.HostKeyCallback, error) {
+	files := c.KnownHostsFiles
+
+	if len(files) == 0 && c.KnownHostsData == nil {
+		if !c.StrictHostKeyChecking && !c.AcceptNewHostKeys {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKnownHosts, err)
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+
+	var callbacks []ssh.HostKeyCallback
+
+	if len(files) > 0 {
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKnownHosts, err)
+		}
+		callbacks = append(callbacks, callback)
+	}
+
+	// KnownHostsData is checked in memory, knownhosts can only read files
+	if c.KnownHostsData != nil {
+		db, err := parseKnownHostsData(c.KnownHostsData)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKnownHosts, err)
+		}
+		callbacks = append(callbacks, db.callback())
+	}
+
+	callback := callbacks[0]
+	if len(callbacks) > 1 {
+		callback = anyHostKeyCallback(callbacks)
+	}
+
+	if c.AcceptNewHostKeys {
+		return acceptNewHostKeys(callback), nil
+	}
+	return callback, nil
+}
+
+// anyHostKeyCallback accepts a host key if any of callbacks accepts it and
+// none of them has it revoked.  If none of them accepts it we return the
+// first error that isn't a knownhosts.KeyError, or else a KeyError with the
+// keys all of them want, so a host that is unknown to all of them still has
+// an empty Want.
+func anyHostKeyCallback(callbacks []ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var (
+			accepted bool
+			firstErr error
+			keyErr   = &knownhosts.KeyError{}
+		)
+
+		for _, callback := range callbacks {
+			err := callback(hostname, remote, key)
+			if err == nil {
+				accepted = true
+				continue
+			}
+
+			var revokedErr *knownhosts.RevokedError
+			if errors.As(err, &revokedErr) {
+				return err
+			}
+
+			var ke *knownhosts.KeyError
+			if errors.As(err, &ke) {
+				keyErr.Want = append(keyErr.Want, ke.Want...)
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if accepted {
+			return nil
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+		return keyErr
+	}
+}
+
+// knownHostsDataName is the file name we report in the knownhosts errors for
+// keys from KnownHostsData.
+const knownHostsDataName = "KnownHostsData"
+
+// knownHostsDB is KnownHostsData parsed.  It matches hosts the way OpenSSH
+// does, with hashed hostnames, wildcards and negated patterns.
+type knownHostsDB struct {
+	lines []knownHostsLine
+}
+
+type knownHostsLine struct {
+	marker   string
+	patterns []string
+	key      knownhosts.KnownKey
+}
+
+func parseKnownHostsData(data []byte) (*knownHostsDB, error) {
+	db := &knownHostsDB{}
+
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		marker, patterns, key, _, _, err := ssh.ParseKnownHosts(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", knownHostsDataName, n+1, err)
+		}
+
+		db.lines = append(db.lines, knownHostsLine{
+			marker:   marker,
+			patterns: patterns,
+			key:      knownhosts.KnownKey{Key: key, Filename: knownHostsDataName, Line: n + 1},
+		})
+	}
+	return db, nil
+}
+
+// callback returns a host key callback that checks plain host keys against
+// the lines without a marker and host certificates against the
+// @cert-authority lines.  Keys on @revoked lines are rejected for every host.
+func (db *knownHostsDB) callback() ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return db.find("cert-authority", address, auth)
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return db.revoked(cert) != nil
+		},
+		HostKeyFallback: db.check,
+	}
+	return checker.CheckHostKey
+}
+
+func (db *knownHostsDB) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if revoked := db.revoked(key); revoked != nil {
+		return &knownhosts.RevokedError{Revoked: *revoked}
+	}
+
+	address := hostname
+	if address == "" {
+		address = remote.String()
+	}
+
+	if db.find("", address, key) {
+		return nil
+	}
+
+	keyErr := &knownhosts.KeyError{}
+	host := knownhosts.Normalize(address)
+	for _, l := range db.lines {
+		if l.marker == "" && matchHostPatterns(l.patterns, host) {
+			keyErr.Want = append(keyErr.Want, l.key)
+		}
+	}
+	return keyErr
+}
+
+// find reports whether there is a line with marker that lists key for address.
+func (db *knownHostsDB) find(marker, address string, key ssh.PublicKey) bool {
+	host := knownhosts.Normalize(address)
+	for _, l := range db.lines {
+		if l.marker == marker && keysEqual(l.key.Key, key) && matchHostPatterns(l.patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// revoked returns the @revoked line for key, or nil if it isn't revoked.
+func (db *knownHostsDB) revoked(key ssh.PublicKey) *knownhosts.KnownKey {
+	for _, l := range db.lines {
+		if l.marker == "revoked" && keysEqual(l.key.Key, key) {
+			return &l.key
+		}
+	}
+	return nil
+}
+
+// matchHostPatterns reports whether host, normalized by knownhosts.Normalize,
+// matches the host patterns of a known_hosts line.  A matching negated
+// pattern means the line doesn't apply even if another pattern matches.
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+
+		if !matchHostPattern(pattern, host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		return matchHashedHost(pattern, host)
+	}
+	if strings.ContainsAny(pattern, "*?") {
+		return wildcardMatch(pattern, host)
+	}
+	return knownhosts.Normalize(pattern) == host
+}
+
+// matchHashedHost matches a hostname hashed by knownhosts.HashHostname or
+// OpenSSH's HashKnownHosts, which is |1|salt|hash with both in base64 and the
+// hash being the HMAC-SHA1 of the hostname keyed by the salt.
+func matchHashedHost(pattern, host string) bool {
+	salt64, hash64, ok := strings.Cut(strings.TrimPrefix(pattern, "|1|"), "|")
+	if !ok {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// wildcardMatch matches s against pattern, where * matches any number of
+// characters and ? matches exactly one.
+func wildcardMatch(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if s == "" {
+				return false
+			}
+
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// acceptNewHostKeys wraps a knownhosts callback so that hosts it has no keys
+// for are accepted.  Keys that don't match the ones recorded for a host are
+// still rejected.
+func acceptNewHostKeys(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil
+		}
+		return err
+	}
+}
+
+// observeHostKeys wraps callback so that observer is called for every host key
+// that callback accepts.
+func observeHostKeys(callback ssh.HostKeyCallback, observer func(hop string, key ssh.PublicKey)) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			observer(hostname, key)
+		}
+		return err
+	}
+}
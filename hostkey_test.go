@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeKnownHosts(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	data := ""
+	for _, line := range lines {
+		data += line + "\n"
+	}
+	err := os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKnownHostsCallbackMultipleFiles(t *testing.T) {
+	key := newHostKey(t)
+	other := newHostKey(t)
+
+	first := writeKnownHosts(t, "first", knownhosts.Line([]string{"other.example.com:22"}, other))
+	second := writeKnownHosts(t, "second", knownhosts.Line([]string{"bastion.example.com:22"}, key))
+
+	callback, err := knownHostsCallback(Config{KnownHostsFiles: []string{first, second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	err = callback("bastion.example.com:22", remote, key)
+	if err != nil {
+		t.Errorf("key only listed in the second file was rejected: %v", err)
+	}
+
+	err = callback("bastion.example.com:22", remote, other)
+	if err == nil {
+		t.Errorf("expected a key that doesn't match the recorded one to be rejected")
+	}
+}
+
+func TestKnownHostsData(t *testing.T) {
+	bastion := newHostKey(t)
+	internal := newHostKey(t)
+	hashed := newHostKey(t)
+	revoked := newHostKey(t)
+
+	data := strings.Join([]string{
+		"# comment",
+		knownhosts.Line([]string{"bastion.example.com"}, bastion),
+		knownhosts.Line([]string{"*.internal.example.com", "!secret.internal.example.com"}, internal),
+		knownhosts.Line([]string{knownhosts.HashHostname("[hashed.example.com]:2222")}, hashed),
+		"@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(revoked))),
+		"",
+	}, "\n")
+
+	callback, err := knownHostsCallback(Config{KnownHostsData: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		accept   bool
+		unknown  bool
+	}{
+		{"plain", "bastion.example.com:22", bastion, true, false},
+		{"wrong key", "bastion.example.com:22", internal, false, false},
+		{"other port", "bastion.example.com:2222", bastion, false, true},
+		{"wildcard", "db.internal.example.com:22", internal, true, false},
+		{"negated", "secret.internal.example.com:22", internal, false, true},
+		{"hashed", "hashed.example.com:2222", hashed, true, false},
+		{"hashed other port", "hashed.example.com:22", hashed, false, true},
+		{"unknown", "unknown.example.com:22", bastion, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := callback(test.hostname, remote, test.key)
+			if test.accept {
+				if err != nil {
+					t.Fatalf("expected the key to be accepted, got %v", err)
+				}
+				return
+			}
+
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				t.Fatalf("expected a knownhosts.KeyError, got %v", err)
+			}
+			if unknown := len(keyErr.Want) == 0; unknown != test.unknown {
+				t.Fatalf("expected unknown=%v, got Want=%v", test.unknown, keyErr.Want)
+			}
+		})
+	}
+
+	err = callback("bastion.example.com:22", remote, revoked)
+	var revokedErr *knownhosts.RevokedError
+	if !errors.As(err, &revokedErr) {
+		t.Fatalf("expected a knownhosts.RevokedError, got %v", err)
+	}
+}
+
+func TestKnownHostsDataWithFiles(t *testing.T) {
+	fromFile := newHostKey(t)
+	fromData := newHostKey(t)
+
+	file := writeKnownHosts(t, "known_hosts", knownhosts.Line([]string{"file.example.com"}, fromFile))
+	data := knownhosts.Line([]string{"data.example.com"}, fromData) + "\n"
+
+	c := Config{
+		KnownHostsFiles:   []string{file},
+		KnownHostsData:    []byte(data),
+		AcceptNewHostKeys: true,
+	}
+	callback, err := knownHostsCallback(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	err = callback("file.example.com:22", remote, fromFile)
+	if err != nil {
+		t.Errorf("key from KnownHostsFiles was rejected: %v", err)
+	}
+
+	err = callback("data.example.com:22", remote, fromData)
+	if err != nil {
+		t.Errorf("key from KnownHostsData was rejected: %v", err)
+	}
+
+	err = callback("data.example.com:22", remote, fromFile)
+	if err == nil {
+		t.Errorf("expected a key that doesn't match KnownHostsData to be rejected")
+	}
+
+	err = callback("new.example.com:22", remote, fromFile)
+	if err != nil {
+		t.Errorf("expected AcceptNewHostKeys to accept an unknown host, got %v", err)
+	}
+}
+
+func TestKnownHostsDataInvalid(t *testing.T) {
+	_, err := knownHostsCallback(Config{KnownHostsData: []byte("bastion.example.com ssh-ed25519 not-base64\n")})
+	if !errors.Is(err, ErrKnownHosts) {
+		t.Fatalf("expected ErrKnownHosts, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPTransport returns an HTTP transport that makes all its connections
+// through the tunnel.  It is a clone of http.DefaultTransport, so it has the
+// same idle connection settings, except that it doesn't use proxies from the
+// environment since they would be reached through the tunnel anyway.  If
+// http.DefaultTransport has been replaced by something that isn't an
+// *http.Transport we use the settings of the standard DefaultTransport.
+func (t *Tunnel) HTTPTransport() *http.Transport {
+	var transport *http.Transport
+
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = dt.Clone()
+	} else {
+		transport = &http.Transport{
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+	}
+
+	transport.Proxy = nil
+	transport.DialContext = t.DialContext
+	return transport
+}
+
+// HTTPClient returns an HTTP client that uses HTTPTransport.
+func (t *Tunnel) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: t.HTTPTransport(),
+	}
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"context"
+)
+
+// Limiter limits how many connections to first hops are set up at the same
+// time.  Share a Limiter between tunnels by setting it as the ConnectLimiter
+// of each of their configs; the limit then applies across all of them.  This
+// is useful to avoid flooding a bastion with handshakes when you start a lot
+// of tunnels at once.
+//
+// Create a Limiter with NewLimiter.  The zero value doesn't limit anything.
+type Limiter struct {
+	sem chan struct{}
+}
+
+// NewLimiter creates a Limiter that allows n concurrent first hop connection
+// attempts.
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return &Limiter{
+		sem: make(chan struct{}, n),
+	}
+}
+
+func (l *Limiter) acquire(ctx context.Context) error {
+	if l.sem == nil {
+		return nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) release() {
+	if l.sem == nil {
+		return
+	}
+	<-l.sem
+}
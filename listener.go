@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Backoff bounds for retrying temporary Accept errors in ServeRemote.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// contextListener is a listener that is closed when ctx is done.  Accept
+// returns ctx.Err() rather than net.ErrClosed when that happens so callers
+// can tell an intentional shutdown from a real error.
+type contextListener struct {
+	net.Listener
+	ctx  context.Context
+	stop func() bool
+}
+
+func newContextListener(ctx context.Context, ln net.Listener) *contextListener {
+	return &contextListener{
+		Listener: ln,
+		ctx:      ctx,
+		stop:     context.AfterFunc(ctx, func() { ln.Close() }),
+	}
+}
+
+func (l *contextListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil && l.ctx.Err() != nil {
+		return nil, l.ctx.Err()
+	}
+	return conn, err
+}
+
+func (l *contextListener) Close() error {
+	l.stop()
+	return l.Listener.Close()
+}
+
+// ServeRemote listens to laddr at the end of the tunnel and calls handler in a
+// new goroutine for each connection it accepts.  It returns ctx.Err() when ctx
+// is done, ErrClosed when the tunnel is shut down, and the error from Accept
+// if it fails with a permanent error.  Temporary Accept errors are retried
+// with a short backoff.  Before returning it closes the connections that are
+// still open and waits for their handlers to return.
+func (t *Tunnel) ServeRemote(ctx context.Context, network, laddr string, handler func(net.Conn)) error {
+	return t.serveRemote(ctx, network, laddr, func(_ context.Context, conn net.Conn) { handler(conn) })
+}
+
+// serveRemote is ServeRemote, but handler is also given a context that is
+// cancelled as soon as we start shutting down, before we close the
+// connections and wait for the handlers.
+func (t *Tunnel) serveRemote(ctx context.Context, network, laddr string, handler func(context.Context, net.Conn)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ln, err := t.ListenContext(ctx, network, laddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = map[net.Conn]struct{}{}
+	)
+
+	defer func() {
+		cancel()
+
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	var backoff time.Duration
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !isTemporary(err) {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return t.errIfClosed(err)
+			}
+
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else {
+				backoff = min(2*backoff, maxAcceptBackoff)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+
+			handler(ctx, conn)
+		}()
+	}
+}
+
+// isTemporary reports whether err is an Accept error worth retrying.
+func isTemporary(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && (ne.Timeout() || ne.Temporary())
+}
+
+// RemoteProxy listens to rbind at the end of the tunnel and connects every
+// connection it accepts to ltarget on the local side, which is the reverse of
+// dialing through the tunnel.  Connections to ltarget that fail are dropped.
+// It returns when ctx is done, see ServeRemote.
+func (t *Tunnel) RemoteProxy(ctx context.Context, rbind, ltarget string) error {
+	var dialer net.Dialer
+
+	// the handler's ctx is also cancelled when ServeRemote returns because
+	// the tunnel was shut down, so local is closed along with remote
+	return t.serveRemote(ctx, "tcp", rbind, func(ctx context.Context, remote net.Conn) {
+		local, err := dialer.DialContext(ctx, "tcp", ltarget)
+		if err != nil {
+			return
+		}
+		defer local.Close()
+
+		stop := context.AfterFunc(ctx, func() { local.Close() })
+		defer stop()
+
+		pipe(remote, local)
+	})
+}
+
+// pipe copies between a and b in both directions until both directions are
+// done.  When one direction reaches EOF we half-close the connection it was
+// writing to if we can.  If the copy failed, or the connection can't be
+// half-closed, we close both connections since the other direction would
+// otherwise never finish.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, err := io.Copy(dst, src)
+		if err == nil && closeWrite(dst) == nil {
+			return
+		}
+		a.Close()
+		b.Close()
+	}
+
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
+
+// closeWrite half-closes conn, or returns an error if conn can't do that.
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
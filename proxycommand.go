@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// proxyCommandConn is a connection to a hop that runs over the stdin and
+// stdout of a command on the hop before it.
+type proxyCommandConn struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	addr    proxyCommandAddr
+}
+
+// proxyCommandAddr is the address of a proxyCommandConn, which is the address
+// of the hop the command connects to.
+type proxyCommandAddr string
+
+// openProxyCommand runs command on client, with %h and %p replaced by the host
+// and port of addr, and returns a connection over its stdin and stdout.
+func openProxyCommand(client *ssh.Client, command string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	command = strings.NewReplacer("%h", host, "%p", port, "%%", "%").Replace(command)
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	err = session.Start(command)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("proxy command [%s]: %w", command, err)
+	}
+
+	return &proxyCommandConn{
+		session: session,
+		stdin:   stdin,
+		stdout:  stdout,
+		addr:    proxyCommandAddr(addr),
+	}, nil
+}
+
+// proxyCommandDialer creates an SSH dialer that reaches each address by
+// running command on client.
+func proxyCommandDialer(client *ssh.Client, command string) sshDialerFunc {
+	return func(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		conn, err := dialWithContext(ctx, func() (net.Conn, error) {
+			return openProxyCommand(client, command, addr)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrHostUnreachable, err)
+		}
+		return newClient(ctx, conn, addr, config)
+	}
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *proxyCommandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *proxyCommandConn) Close() error {
+	c.stdin.Close()
+	return c.session.Close()
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr  { return c.addr }
+func (c *proxyCommandConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *proxyCommandConn) SetDeadline(time.Time) error      { return errDeadlineNotSupported }
+func (c *proxyCommandConn) SetReadDeadline(time.Time) error  { return errDeadlineNotSupported }
+func (c *proxyCommandConn) SetWriteDeadline(time.Time) error { return errDeadlineNotSupported }
+
+func (a proxyCommandAddr) Network() string { return "proxycommand" }
+func (a proxyCommandAddr) String() string  { return string(a) }
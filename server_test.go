@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner returns a new ed25519 signer.
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestServer starts an SSH server on localhost that accepts any public key
+// and forwards direct-tcpip channels, and returns it as a hop.  If configure
+// is non-nil it is called with the server config before we start listening.
+// The server is stopped when the test ends.
+func newTestServer(t *testing.T, configure func(*ssh.ServerConfig)) string {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(newSigner(t))
+	if configure != nil {
+		configure(config)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveTestConn(conn, config)
+			}()
+		}
+	}()
+
+	return "test@" + ln.Addr().String()
+}
+
+// serveTestConn runs the server side of an SSH connection.  Global requests
+// are refused and the only channels we accept are direct-tcpip.
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		var msg directTCPIPMsg
+		err := ssh.Unmarshal(nc.ExtraData(), &msg)
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port))))
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+
+		go func() {
+			defer ch.Close()
+			defer target.Close()
+
+			done := make(chan struct{}, 2)
+			go func() { io.Copy(ch, target); done <- struct{}{} }()
+			go func() { io.Copy(target, ch); done <- struct{}{} }()
+			<-done
+		}()
+	}
+}
+
+// newTestTunnel creates a tunnel through hops that authenticates with a new
+// key and without the ssh-agent.
+func newTestTunnel(t *testing.T, c Config) *Tunnel {
+	t.Helper()
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	c.Signers = append(c.Signers, newSigner(t))
+
+	tun, err := Create(c)
+	if err != nil {
+		t.Fatalf("creating tunnel: %v", err)
+	}
+	t.Cleanup(func() { tun.Shutdown() })
+	return tun
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errors
+var (
+	ErrSession = errors.New("session error")
+)
+
+// PTYConfig describes the pseudo terminal to request when opening a shell.
+type PTYConfig struct {
+	// Term is the terminal type.  If empty we use "xterm".
+	Term string
+
+	// Width and Height of the terminal in characters.
+	Width  int
+	Height int
+
+	// Modes are the terminal modes to request.
+	Modes ssh.TerminalModes
+
+	// Resize is an optional channel of new window sizes that are passed on
+	// to the remote end when the local terminal is resized.
+	Resize <-chan WindowSize
+}
+
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// Shell opens an interactive shell on the last hop and streams stdin, stdout
+// and stderr until the shell exits or ctx is done.  If pty is non-nil we
+// request a pseudo terminal for the shell.  The variables in Config.Env are set
+// in the shell's environment where the server allows it.
+func (t *Tunnel) Shell(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, pty *PTYConfig) error {
+	last, _, release, err := t.acquireClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := last.NewSession()
+	if err != nil {
+		return t.errIfClosed(fmt.Errorf("%w: %v", ErrSession, err))
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	// sshd only accepts the variables listed in AcceptEnv, so we don't let a
+	// rejected variable stop us from opening the shell
+	for name, value := range t.config.Env {
+		session.Setenv(name, value)
+	}
+
+	var resize <-chan WindowSize
+	if pty != nil {
+		term := pty.Term
+		if term == "" {
+			term = "xterm"
+		}
+
+		err := session.RequestPty(term, pty.Height, pty.Width, pty.Modes)
+		if err != nil {
+			return fmt.Errorf("%w: requesting pty: %v", ErrSession, err)
+		}
+		resize = pty.Resize
+	}
+
+	err = session.Shell()
+	if err != nil {
+		return fmt.Errorf("%w: starting shell: %v", ErrSession, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+
+		case <-ctx.Done():
+			session.Close()
+			return ctx.Err()
+
+		case size, ok := <-resize:
+			if !ok {
+				resize = nil
+				continue
+			}
+			session.WindowChange(size.Height, size.Width)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+)
+
+// ConnectStdio dials addr from the end of the tunnel and copies in to the
+// connection and the connection to out until either side closes or ctx is
+// done.  This lets you use the tunnel as an OpenSSH ProxyCommand by passing
+// os.Stdin and os.Stdout.
+//
+// When in reaches EOF we half-close the connection and keep copying to out
+// until the other end closes, so a response sent after the end of the input
+// isn't lost.
+//
+// The connection is closed when ConnectStdio returns.  Note that a read from
+// in that is blocked at that point stays blocked until in returns.
+func (t *Tunnel) ConnectStdio(ctx context.Context, network, addr string, in io.Reader, out io.Writer) error {
+	conn, err := t.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	inDone := make(chan error, 1)
+	outDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, in)
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		inDone <- err
+	}()
+	go func() {
+		_, err := io.Copy(out, conn)
+		outDone <- err
+	}()
+
+	select {
+	case err = <-inDone:
+		if err == nil {
+			err = <-outDone
+		}
+	case err = <-outDone:
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// DialTLS dials addr from the end of the tunnel and performs a TLS handshake
+// over the connection.  If cfg is nil or cfg.ServerName is empty the server
+// name is taken from the host part of addr.
+func (t *Tunnel) DialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := t.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
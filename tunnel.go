@@ -1,9 +1,10 @@
 // Package tunnel implements a tunnel to another machine from which we can Dial
-// other machines or Listen to remote ports. SSH keys are loaded from ssh-agent.
+// other machines or Listen to remote ports. SSH keys are loaded from ssh-agent
+// and from any signers given in the Config.
 //
-// For now this library won't check host keys (it just accepts all) and for
-// simplicity it assumes that you are using an ssh-agent to access your ssh
-// keys.
+// Unless you set StrictHostKeyChecking this library won't check host keys (it
+// just accepts all) and for simplicity it assumes that you are using an
+// ssh-agent to access your ssh keys.
 //
 // Typical use:
 //
@@ -33,33 +34,281 @@
 package tunnel
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
-	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/proxy"
 )
 
 // Tunnel instance.
+//
+// Tunnel implements proxy.Dialer and proxy.ContextDialer from
+// golang.org/x/net/proxy, so it can be passed to anything that accepts those.
 type Tunnel struct {
-	last   *ssh.Client
-	config Config
-	hops   []hop
+	// config.Signers is guarded by mu since SetSigners can change it.
+	config          Config
+	hops            []Hop
+	agentClient     agent.ExtendedAgent
+	agentConn       net.Conn
+	hostKeyCallback ssh.HostKeyCallback
+
+	// ctx is cancelled by Shutdown to abort chains that are being connected.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stopContext stops the shutdown triggered by Config.Context.
+	stopContext func() bool
+
+	mu      sync.Mutex
+	last    *ssh.Client
+	clients []*ssh.Client
+	path    []Hop
+	closed  bool
+
+	// closeErr is the reason given to ShutdownWithError
+	closeErr error
+
+	// extra holds additional connections to the last hop when
+	// MaxSessionsPerHop is set and channels counts the open channels on
+	// each connection to the last hop.
+	extra    []*ssh.Client
+	channels map[*ssh.Client]int
+
+	// connecting is closed when the extra connection that is being made to
+	// the last hop is ready, and is nil when none is being made.
+	connecting chan struct{}
+
+	// conns are the connections dialed through the tunnel that have not
+	// been closed yet.
+	conns map[*tunnelConn]struct{}
+
+	// done is created by Done and closed when Shutdown has completed.
+	done chan struct{}
 }
 
 // Config for Tunnel.
 type Config struct {
 	// Hops is a list of user@host:port elements, the last of which defines
 	// the target host. We need at least one entry, but we support an arbitrary
-	// number of hops.
+	// number of hops.  Hops can also be given as ssh://user@host:port URLs,
+	// in which case the port is optional and defaults to 22.
+	//
+	// A hop can list alternative addresses after the first one, separated by
+	// commas, eg. "bob@bastion1.example.com:22,bastion2.example.com:22".  The
+	// addresses are tried in order until we manage to connect to one of them.
 	Hops []string
+
+	// Env holds environment variables to set for shells opened with Shell.
+	// Most servers only accept the variables listed in AcceptEnv in their
+	// sshd_config.  Variables the server refuses are skipped.
+	Env map[string]string
+
+	// ProxyCommands maps the index of a hop in Hops to a command that is
+	// run on the hop before it to connect to it, for bastions that don't
+	// allow direct-tcpip but let you run eg. "nc %h %p".  %h and %p are
+	// replaced by the host and port of the hop.  The command's stdin and
+	// stdout are used as the connection, like OpenSSH's ProxyCommand.  The
+	// first hop has no hop before it, so it can't have a proxy command.
+	ProxyCommands map[int]string
+
+	// OnHopConnected is called after each hop in the chain has been
+	// connected, with the index of the hop in Hops.
+	OnHopConnected func(index int, hop Hop)
+
+	// OnDialError is called when Dial fails.
+	OnDialError func(addr string, err error)
+
+	// OnShutdown is called once, when the first call to Shutdown has torn
+	// down the tunnel.
+	OnShutdown func()
+
+	// ParallelDial makes us dial the addresses of the first hop concurrently
+	// rather than one after the other.  A new attempt is started every 250ms
+	// until one of them connects.
+	ParallelDial bool
+
+	// ClientVersion overrides the version string we send to every hop.  It
+	// must start with "SSH-2.0-".  If empty the x/crypto/ssh default is used.
+	ClientVersion string
+
+	// BannerCallback is called with any banner message a hop sends us
+	// during authentication.
+	BannerCallback ssh.BannerCallback
+
+	// Resolver is used to resolve the host name of the first hop.  The hosts
+	// of the other hops are resolved on the hop before them.  If nil the
+	// default resolver is used.
+	Resolver *net.Resolver
+
+	// HopTimeout bounds each attempt to connect to a hop, covering the
+	// network dial, the SSH handshake and authentication.  If a hop has
+	// fallback addresses each address gets its own attempt.  On the first
+	// hop each retry of the dial is an attempt of its own too, and the
+	// clock starts once the attempt holds a ConnectLimiter slot, so neither
+	// the wait for a slot nor the backoff between retries counts against
+	// it.  Zero means no timeout.
+	HopTimeout time.Duration
+
+	// ConnectTimeout bounds the time it takes to build the entire chain of
+	// hops.  If it is exceeded the HopError for the hop we were connecting to
+	// wraps ErrConnectTimeout.  Zero means no timeout.
+	ConnectTimeout time.Duration
+
+	// FirstHopRetries is the number of times we retry the network dial to
+	// the first hop if it fails, waiting FirstHopBackoff before the first
+	// retry and doubling the wait for each retry after that, up to a
+	// minute.  Only the dial is retried, SSH handshake and authentication
+	// failures are not.  Neither may be negative.
+	FirstHopRetries int
+	FirstHopBackoff time.Duration
+
+	// StrictHostKeyChecking makes us verify the host key of every hop against
+	// ~/.ssh/known_hosts.  If false we accept any host key.
+	StrictHostKeyChecking bool
+
+	// AcceptNewHostKeys verifies host keys like StrictHostKeyChecking, but
+	// accepts hosts that have no entry in known_hosts.  A host key that
+	// doesn't match the one on record is still rejected.  Like OpenSSH's
+	// "accept-new", except that we don't write new keys to known_hosts; use
+	// HostKeyObserver if you want to record them.
+	AcceptNewHostKeys bool
+
+	// KnownHostsFiles is a list of known_hosts files to verify host keys
+	// against.  A host key found in any of them is accepted.  If set (or if
+	// KnownHostsData is set) they are used instead of ~/.ssh/known_hosts.
+	KnownHostsFiles []string
+
+	// KnownHostsData is the contents of a known_hosts file to verify host
+	// keys against, for when you have it in memory rather than on disk.  It
+	// is parsed in memory and never written to disk, and is used along with
+	// KnownHostsFiles.  Hashed hostnames, wildcards, negated patterns,
+	// @cert-authority and @revoked lines are supported.
+	KnownHostsData []byte
+
+	// HostKeyObserver is called with the host:port of the hop and its host key
+	// every time a host key has been verified.  You can use this to record
+	// host keys for pinning them later.
+	HostKeyObserver func(hop string, key ssh.PublicKey)
+
+	// HostCAs are the keys of SSH certificate authorities we trust to sign
+	// host keys.  A hop that presents a host certificate signed by one of
+	// them, valid for its host name and for the current time, is accepted.
+	// Plain host keys are rejected unless known_hosts checking is also
+	// enabled, in which case they are verified against known_hosts.
+	HostCAs []ssh.PublicKey
+
+	// Signers are offered when authenticating, before the keys in the
+	// ssh-agent.  Use ParseKeyFile to load keys from files.  If you provide
+	// signers the ssh-agent is only used if AgentSocket is set or
+	// SSH_AUTH_SOCK points at an agent we can connect to.
+	Signers []ssh.Signer
+
+	// AgentSocket is the path of the ssh-agent socket.  If empty we use
+	// SSH_AUTH_SOCK.  If AgentSocket is set and we can't connect to it,
+	// Create fails with ErrOpeningAuthSock.  If the socket comes from
+	// SSH_AUTH_SOCK it only does so when there are no Signers.
+	AgentSocket string
+
+	// MaxSessionsPerHop limits the number of channels we open on a single
+	// SSH connection to the last hop.  When every connection to the last hop
+	// has this many open channels, Dial opens another connection to it and
+	// new channels are spread across the connections.  Dials and shells count
+	// towards the limit, and an extra connection is closed once its last
+	// channel is closed.  Zero means no limit.
+	MaxSessionsPerHop int
+
+	// Context, if set, ties the lifetime of the tunnel to the context: the
+	// tunnel is shut down when the context is done.
+	Context context.Context
+
+	// HandshakeTrace, if set, gets a line for every hop we connect to with
+	// the addresses, the client and server versions and the session id.
+	// x/crypto/ssh doesn't tell us which algorithms or auth method were
+	// chosen, so that is not included.
+	HandshakeTrace io.Writer
+
+	// RejectDuplicateHops makes Create fail with ErrDuplicateHop if the same
+	// host:port appears more than once in Hops.
+	RejectDuplicateHops bool
+
+	// FirstHopDialer, if set, is used instead of a net.Dialer to connect to
+	// the first hop.  You can use this to reach the first hop through an HTTP
+	// CONNECT proxy, a WebSocket or some other transport.  Resolver is not
+	// used when FirstHopDialer is set.
+	FirstHopDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ListenPortRangeStart and ListenPortRangeEnd, if set, make Listen try
+	// the ports from start to end (inclusive) in order when asked to listen
+	// to port 0, returning a listener on the first one that is available.
+	// This is useful when several instances compete for ports on a shared
+	// host.  The listener's Addr reports the port that was bound.
+	ListenPortRangeStart int
+	ListenPortRangeEnd   int
+
+	// RemoteBindAll makes Listen bind to all interfaces on the last hop when
+	// a tcp address has no host, eg. ":8080".  The server will still only
+	// bind to loopback unless GatewayPorts is enabled in its sshd_config, and
+	// since the SSH protocol doesn't report the address that was actually
+	// bound we have no way of detecting that.
+	RemoteBindAll bool
+
+	// ConnectLimiter, if set, limits the number of concurrent connection
+	// attempts to first hops.  The limit covers the dial, handshake and
+	// authentication and is shared by all tunnels using the same Limiter.
+	// A slot is held for one attempt at a time and given back while we back
+	// off before a retry.  The wait for a slot is only bounded by the
+	// context and ConnectTimeout, HopTimeout starts once we have one.
+	ConnectLimiter *Limiter
+
+	// TCPKeepAlive, if set, is the period of the TCP keepalives on the TCP
+	// connection to the first hop.  net.Dialer already enables keepalives
+	// every 15 seconds, so this is for when you need a shorter period to
+	// detect dead NAT mappings on the way to the first hop.  Connections from
+	// a FirstHopDialer get keepalives with this period if they are
+	// *net.TCPConn, otherwise it has no effect on them.
+	TCPKeepAlive time.Duration
+
+	// LocalAddr, if set, is the local address we connect to the first hop
+	// from, eg. to pick the source IP on a multi-homed host.  The inner hops
+	// are dialed by the hop before them, which gives us no say in the source
+	// address, so it only applies to the first hop.  It is not used when
+	// FirstHopDialer is set.
+	LocalAddr *net.TCPAddr
+
+	// FirstHopNetwork is the network used to dial the first hop: "tcp"
+	// (the default), "tcp4" or "tcp6".  Setting it to "tcp4" is a way
+	// around a first hop with a broken AAAA record.  The inner hops are
+	// always dialed with "tcp".
+	FirstHopNetwork string
 }
 
+// make sure we remain usable as a dialer by libraries that take one.
+var (
+	_ proxy.Dialer        = (*Tunnel)(nil)
+	_ proxy.ContextDialer = (*Tunnel)(nil)
+)
+
+// parallelDialStagger is the delay between starting each attempt when
+// dialing the first hop in parallel.
+const parallelDialStagger = 250 * time.Millisecond
+
+// maxFirstHopBackoff caps the wait between retries of the first hop.
+const maxFirstHopBackoff = time.Minute
+
 // sshDialerFunc is just a convenient type to make the func signature  for
 // sshDialerFromClient look a bit more tidy
-type sshDialerFunc func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
+type sshDialerFunc func(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
 
 var (
 	// ErrConnectAgent indicates that we failed to connect to the ssh-agent
@@ -75,6 +324,29 @@ var (
 	// ErrClosingHop indicates that we got an error while trying to close a connection when tearing
 	// down the tunnel.
 	ErrClosingHop = errors.New("error closing hop")
+	// ErrHostUnreachable indicates that we were unable to reach a hop over the network.
+	ErrHostUnreachable = errors.New("host unreachable")
+	// ErrAuthFailed indicates that a hop rejected our credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrClosed indicates that the tunnel has been shut down.
+	ErrClosed = errors.New("tunnel is closed")
+	// ErrInvalidClientVersion indicates that the ClientVersion does not start with "SSH-2.0-".
+	ErrInvalidClientVersion = errors.New("client version must start with SSH-2.0-")
+	// ErrConnectTimeout indicates that building the chain took longer than ConnectTimeout.
+	ErrConnectTimeout = errors.New("connect timeout exceeded")
+	// ErrInvalidHopIndex indicates that a hop index was out of range.
+	ErrInvalidHopIndex = errors.New("invalid hop index")
+	// ErrForwardingNotPermitted indicates that the last hop refused to listen
+	// on our behalf.  The server doesn't say why, so either the port is in
+	// use or forwarding is not allowed; check AllowTcpForwarding and
+	// GatewayPorts in its sshd_config.
+	ErrForwardingNotPermitted = errors.New("remote forwarding not permitted")
+	// ErrInvalidPortRange indicates that ListenPortRangeStart and ListenPortRangeEnd do not form a valid range.
+	ErrInvalidPortRange = errors.New("invalid listen port range")
+	// ErrInvalidRetries indicates that FirstHopRetries or FirstHopBackoff is negative.
+	ErrInvalidRetries = errors.New("invalid first hop retries")
+	// ErrUnsupportedNetwork indicates that the network can't be dialed through SSH.
+	ErrUnsupportedNetwork = errors.New("unsupported network")
 )
 
 // Create new tunnel instance.
@@ -83,92 +355,805 @@ func Create(c Config) (*Tunnel, error) {
 		return nil, ErrNoHopsSpecified
 	}
 
+	if c.ClientVersion != "" && !strings.HasPrefix(c.ClientVersion, "SSH-2.0-") {
+		return nil, fmt.Errorf("%w: [%s]", ErrInvalidClientVersion, c.ClientVersion)
+	}
+
 	hops, err := parseHops(c.Hops)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrParsingHops, err)
 	}
 
-	// open connection to ssh agent
-	authSockPath := os.Getenv("SSH_AUTH_SOCK")
-	conn, err := net.Dial("unix", authSockPath)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrOpeningAuthSock, err)
+	if c.FirstHopRetries < 0 || c.FirstHopBackoff < 0 {
+		return nil, fmt.Errorf("%w: %d retries with backoff %v", ErrInvalidRetries, c.FirstHopRetries, c.FirstHopBackoff)
 	}
-	agentClient := agent.NewClient(conn)
 
-	tunnel := &Tunnel{
-		config: c,
+	if c.ListenPortRangeStart != 0 || c.ListenPortRangeEnd != 0 {
+		if c.ListenPortRangeStart < 1 || c.ListenPortRangeEnd > 65535 || c.ListenPortRangeStart > c.ListenPortRangeEnd {
+			return nil, fmt.Errorf("%w: [%d-%d]", ErrInvalidPortRange, c.ListenPortRangeStart, c.ListenPortRangeEnd)
+		}
 	}
 
-	sshDialer := ssh.Dial
-	for _, hop := range hops {
-		hop.sshClientConfig = ssh.ClientConfig{
-			User: hop.username,
-			Auth: []ssh.AuthMethod{
-				// TODO(borud): make it possible to override
-				ssh.PublicKeysCallback(agentClient.Signers),
-			},
-			// TODO(borud): make this configurable
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	for i, command := range c.ProxyCommands {
+		if i < 1 || i >= len(hops) {
+			return nil, fmt.Errorf("%w: ProxyCommands has %d, tunnel has %d hops", ErrInvalidHopIndex, i, len(hops))
 		}
+		hops[i].ProxyCommand = command
+	}
+
+	switch c.FirstHopNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: FirstHopNetwork [%s], must be one of tcp, tcp4 or tcp6", ErrUnsupportedNetwork, c.FirstHopNetwork)
+	}
 
-		hop.sshClient, err = sshDialer("tcp", fmt.Sprintf("%s:%d", hop.host, hop.port), &hop.sshClientConfig)
+	if c.RejectDuplicateHops {
+		err := checkDuplicateHops(hops)
 		if err != nil {
-			tunnel.Shutdown()
-			return nil, fmt.Errorf("%w to [%s@%s:%d]: %v", ErrCreatingConnection, hop.username, hop.host, hop.port, err)
+			return nil, err
 		}
+	}
+
+	hostKeyCallback, err := resolveHostKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
 
-		tunnel.hops = append(tunnel.hops, hop)
-		tunnel.last = hop.sshClient
-		sshDialer = sshDialerFromClient(hop.sshClient)
+	tunnel := &Tunnel{
+		config:          c,
+		hops:            hops,
+		hostKeyCallback: hostKeyCallback,
+		conns:           map[*tunnelConn]struct{}{},
+	}
+
+	tunnel.agentClient, tunnel.agentConn, err = openAgent(c)
+	if err != nil {
+		return nil, err
 	}
 
+	parent := c.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	tunnel.ctx, tunnel.cancel = context.WithCancel(parent)
+
+	tunnel.clients, tunnel.path, err = tunnel.connect(tunnel.ctx)
+	if err != nil {
+		tunnel.cancel()
+		tunnel.closeAgent()
+		return nil, err
+	}
+	tunnel.last = tunnel.clients[len(tunnel.clients)-1]
+	tunnel.channels = map[*ssh.Client]int{tunnel.last: 0}
+	tunnel.stopContext = context.AfterFunc(parent, func() { tunnel.Shutdown() })
+
 	return tunnel, nil
 }
 
-// Dial from end of tunnel.
+// NewFactory returns a function that creates a new, independent tunnel from c
+// every time it is called.  This is handy when you need a pool of tunnels with
+// the same configuration.
+func NewFactory(c Config) func() (*Tunnel, error) {
+	return func() (*Tunnel, error) {
+		return Create(c)
+	}
+}
+
+// connect builds the chain of SSH clients, one per hop, and returns them along
+// with the path we took, ie. the hops with the addresses we connected to.  If
+// we fail to connect to a hop the clients we have created so far are closed.
+func (t *Tunnel) connect(ctx context.Context) ([]*ssh.Client, []Hop, error) {
+	var clients []*ssh.Client
+	var path []Hop
+
+	if t.config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.config.ConnectTimeout)
+		defer cancel()
+	}
+
+	sshDialer := t.sshDial
+	for i, hop := range t.hops {
+		sshClient, addr, err := t.connectHop(ctx, i, sshDialer)
+		if err != nil {
+			t.closeClients(clients)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: %w", ErrConnectTimeout, err)
+			}
+			return nil, nil, &HopError{
+				Index: i,
+				Hop:   hop,
+				Err:   fmt.Errorf("%w: %w", ErrCreatingConnection, err),
+			}
+		}
+
+		clients = append(clients, sshClient)
+		path = append(path, hop.withAddr(addr))
+		if i+1 < len(t.hops) {
+			sshDialer = t.hopDialer(sshClient, i+1)
+		}
+
+		if t.config.OnHopConnected != nil {
+			t.config.OnHopConnected(i, hop)
+		}
+	}
+
+	return clients, path, nil
+}
+
+// connectHop connects to hop i using sshDialer and returns the client along
+// with the address we connected to.
+func (t *Tunnel) connectHop(ctx context.Context, i int, sshDialer sshDialerFunc) (*ssh.Client, string, error) {
+	hop := t.hops[i]
+
+	sshClientConfig := &ssh.ClientConfig{
+		User: hop.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeysCallback(t.signers),
+		},
+		HostKeyCallback: t.hostKeyCallback,
+		ClientVersion:   t.config.ClientVersion,
+		BannerCallback:  t.config.BannerCallback,
+	}
+
+	// sshDial applies HopTimeout to its attempts itself so the time spent
+	// waiting for a ConnectLimiter slot doesn't count
+	timeout := t.config.HopTimeout
+	if i == 0 {
+		timeout = 0
+	}
+
+	var client *ssh.Client
+	var addr string
+	var err error
+	if i == 0 && t.config.ParallelDial {
+		client, addr, err = dialParallel(ctx, t.sshDial, hop.addrs(), sshClientConfig, timeout)
+	} else {
+		client, addr, err = dialSerial(ctx, sshDialer, hop.addrs(), sshClientConfig, timeout)
+	}
+
+	if err == nil && t.config.HandshakeTrace != nil {
+		fmt.Fprintf(t.config.HandshakeTrace, "hop %d [%s@%s]: local=%s remote=%s client=%q server=%q session=%x\n",
+			i, hop.Username, addr, client.LocalAddr(), client.RemoteAddr(), client.ClientVersion(), client.ServerVersion(), client.SessionID())
+	}
+	return client, addr, err
+}
+
+// Dial from end of tunnel.  Each call opens a new direct-tcpip channel on the
+// SSH connection to the last hop.
 func (t *Tunnel) Dial(n string, addr string) (net.Conn, error) {
-	return t.last.Dial(n, addr)
+	return t.DialContext(context.Background(), n, addr)
+}
+
+// DialContext dials from the end of the tunnel.  If ctx is done before the
+// remote end has accepted the connection we return ctx.Err() and close the
+// connection once the dial completes.
+//
+// The SSH channel the connection runs over does not support deadlines, so
+// they are emulated: when a deadline passes the connection is closed and
+// subsequent reads and writes fail with os.ErrDeadlineExceeded.
+func (t *Tunnel) DialContext(ctx context.Context, n string, addr string) (net.Conn, error) {
+	conn, _, err := t.DialContextTraced(ctx, n, addr)
+	return conn, err
+}
+
+// DialContextTraced works like DialContext but also returns the path the
+// connection took, ie. the hops with the addresses we are connected to.
+func (t *Tunnel) DialContextTraced(ctx context.Context, n string, addr string) (net.Conn, []Hop, error) {
+	if err := checkNetwork(n); err != nil {
+		return nil, nil, err
+	}
+
+	last, path, release, err := t.acquireClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dialClient(ctx, last, n, addr)
+	if err != nil {
+		release()
+		if t.config.OnDialError != nil {
+			t.config.OnDialError(addr, err)
+		}
+		return nil, nil, t.errIfClosed(err)
+	}
+	return t.newConn(ctx, conn, n, addr, path, release), slices.Clone(path), nil
 }
 
-// Listen to port at end of tunnel.
+// CanReach checks that we can connect to addr from the end of the tunnel.  The
+// connection is closed right away, so this is suitable for health checks.
+func (t *Tunnel) CanReach(ctx context.Context, n string, addr string) error {
+	conn, err := t.DialContext(ctx, n, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// DialFromHop dials addr from hop number hopIndex rather than from the end of
+// the tunnel.  This is useful for reaching services that are only visible
+// from one of the intermediate hops.  Dialing from the last hop is the same as
+// DialContext.
+func (t *Tunnel) DialFromHop(ctx context.Context, hopIndex int, n string, addr string) (net.Conn, error) {
+	if hopIndex < 0 || hopIndex >= len(t.hops) {
+		return nil, fmt.Errorf("%w: %d, tunnel has %d hops", ErrInvalidHopIndex, hopIndex, len(t.hops))
+	}
+
+	if err := checkNetwork(n); err != nil {
+		return nil, err
+	}
+
+	// the last hop may have extra connections and counts its channels
+	if hopIndex == len(t.hops)-1 {
+		return t.DialContext(ctx, n, addr)
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		err := t.errClosed()
+		t.mu.Unlock()
+		return nil, err
+	}
+	client := t.clients[hopIndex]
+	path := slices.Clone(t.path[:hopIndex+1])
+	t.mu.Unlock()
+
+	conn, err := dialClient(ctx, client, n, addr)
+	if err != nil {
+		if t.config.OnDialError != nil {
+			t.config.OnDialError(addr, err)
+		}
+		return nil, t.errIfClosed(err)
+	}
+	return t.newConn(ctx, conn, n, addr, path, nil), nil
+}
+
+// Listen to port at end of tunnel.  If you listen to port 0 the server picks
+// the port, and the Addr of the returned listener reports the port that was
+// actually bound.
 func (t *Tunnel) Listen(n string, addr string) (net.Listener, error) {
-	return t.last.Listen(n, addr)
+	return t.ListenContext(context.Background(), n, addr)
+}
+
+// ListenContext listens to a port at the end of the tunnel.  The listener is
+// closed when ctx is done, after which Accept returns ctx.Err().
+//
+// If the last hop refuses to listen we return ErrForwardingNotPermitted.  The
+// SSH protocol doesn't let the server tell us why, but unless the port is
+// already in use it is usually because of AllowTcpForwarding or GatewayPorts
+// in the server's sshd_config.
+//
+// If addr has port 0 and ListenPortRangeStart is set we try the ports in the
+// range in order and return a listener on the first one that is available.
+func (t *Tunnel) ListenContext(ctx context.Context, n string, addr string) (net.Listener, error) {
+	last, _, err := t.lastClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := t.listen(last, n, addr)
+	if err != nil {
+		if isForwardDenied(err) {
+			return nil, fmt.Errorf("%w by [%s] for [%s]: %v", ErrForwardingNotPermitted, t.hops[len(t.hops)-1], addr, err)
+		}
+		return nil, t.errIfClosed(err)
+	}
+
+	if ctx.Done() == nil {
+		return ln, nil
+	}
+	return newContextListener(ctx, ln), nil
+}
+
+// listen listens to addr on client, trying the ports in the listen port range
+// if addr has port 0 and a range is configured.  We stop early if the server
+// won't listen on any port at all.
+func (t *Tunnel) listen(client *ssh.Client, n string, addr string) (net.Listener, error) {
+	start, end := t.config.ListenPortRangeStart, t.config.ListenPortRangeEnd
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && host == "" && t.config.RemoteBindAll {
+		switch n {
+		case "tcp", "tcp4":
+			host = "0.0.0.0"
+		case "tcp6":
+			host = "::"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	if err != nil || port != "0" || start == 0 {
+		return client.Listen(n, addr)
+	}
+
+	for p := start; ; p++ {
+		ln, err := client.Listen(n, net.JoinHostPort(host, strconv.Itoa(p)))
+		if err == nil || p == end || !isForwardDenied(err) {
+			return ln, err
+		}
+
+		// The server refuses in the same way whether the port is in use or
+		// forwarding is disabled altogether.  Let it pick a port once to
+		// find out which, so we don't walk the whole range in vain.
+		if p == start {
+			probe, probeErr := client.Listen(n, net.JoinHostPort(host, "0"))
+			if probeErr != nil {
+				return nil, err
+			}
+			probe.Close()
+		}
+	}
+}
+
+// lastClient returns the client for the last hop along with the path of the
+// chain it belongs to, or ErrClosed if the tunnel has been shut down.
+func (t *Tunnel) lastClient() (*ssh.Client, []Hop, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, nil, t.errClosed()
+	}
+	return t.last, t.path, nil
+}
+
+// errClosed returns ErrClosed, wrapping the reason given to ShutdownWithError
+// if there is one.  Must be called with t.mu held.
+func (t *Tunnel) errClosed() error {
+	if t.closeErr != nil {
+		return fmt.Errorf("%w: %w", ErrClosed, t.closeErr)
+	}
+	return ErrClosed
+}
+
+// errIfClosed returns the error from errClosed if the tunnel has been shut
+// down, and err otherwise.  Operations that fail because the tunnel was shut
+// down while they were in progress use this so they fail with ErrClosed
+// rather than with whatever error the SSH connection gave them.
+func (t *Tunnel) errIfClosed(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return t.errClosed()
+	}
+	return err
+}
+
+// Config returns a copy of the configuration the tunnel was created with.
+// Signers is left out so the copy can be logged without exposing keys; use
+// AuthMethodsSummary to see which credentials are in use.
+func (t *Tunnel) Config() Config {
+	t.mu.Lock()
+	c := t.config
+	t.mu.Unlock()
+
+	c.Hops = slices.Clone(c.Hops)
+	c.ProxyCommands = maps.Clone(c.ProxyCommands)
+	c.Env = maps.Clone(c.Env)
+	c.KnownHostsFiles = slices.Clone(c.KnownHostsFiles)
+	c.KnownHostsData = slices.Clone(c.KnownHostsData)
+	c.HostCAs = slices.Clone(c.HostCAs)
+	c.Signers = nil
+	return c
+}
+
+// NumHops returns the number of hops in the tunnel.
+func (t *Tunnel) NumHops() int {
+	return len(t.hops)
+}
+
+// Connected reports whether the chain is connected, ie. the tunnel has not
+// been shut down.
+func (t *Tunnel) Connected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return !t.closed && len(t.clients) == len(t.hops)
+}
+
+// ServerVersions returns the version string reported by the SSH server on
+// each hop, in the same order as the hops.
+func (t *Tunnel) ServerVersions() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	versions := make([]string, len(t.clients))
+	for i, client := range t.clients {
+		versions[i] = string(client.ServerVersion())
+	}
+	return versions
+}
+
+// Reset tears down the SSH connections of the tunnel and builds a fresh chain
+// using the same configuration.  The new chain is connected before the old one
+// is closed, so Dials that start once it is in place run on the new chain.
+// The old chain is closed right away, so Dials that are still in flight on it
+// fail, and connections, listeners and shells made through it are closed
+// along with it.  If the tunnel is shut down while we are
+// connecting the new chain, Reset is aborted and returns ErrClosed.
+func (t *Tunnel) Reset() error {
+	clients, path, err := t.connect(t.ctx)
+	if err != nil {
+		if t.ctx.Err() != nil {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return t.errClosed()
+		}
+		return err
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		err := t.errClosed()
+		t.mu.Unlock()
+		t.closeClients(clients)
+		return err
+	}
+	old := t.clients
+	oldExtra := t.extra
+	t.clients = clients
+	t.path = path
+	t.last = clients[len(clients)-1]
+	t.extra = nil
+	t.channels = map[*ssh.Client]int{t.last: 0}
+	t.mu.Unlock()
+
+	return errors.Join(t.closeExtra(oldExtra), t.closeClients(old))
 }
 
 // Shutdown tunnel. This will not shut down any connections you have tunneled through
 // so you have to take care of this yourself.
+//
+// It is safe to call Shutdown more than once.  Dialing, listening or opening a
+// shell after Shutdown, or while Shutdown is in progress, returns ErrClosed.
 func (t *Tunnel) Shutdown() error {
+	return t.ShutdownWithError(nil)
+}
+
+// ShutdownWithError shuts down the tunnel like Shutdown, and records reason as
+// the reason why.  Operations on the tunnel after this return an error that
+// wraps both ErrClosed and reason.
+func (t *Tunnel) ShutdownWithError(reason error) error {
+	t.stopContext()
+	t.cancel()
+
+	t.mu.Lock()
+	first := !t.closed
+	if first {
+		t.closeErr = reason
+	}
+	clients := t.clients
+	extra := t.extra
+	t.clients = nil
+	t.last = nil
+	t.extra = nil
+	t.channels = nil
+	t.closed = true
+	t.mu.Unlock()
+
+	errs := errors.Join(t.closeExtra(extra), t.closeClients(clients))
+	if first {
+		t.closeAgent()
+	}
+
+	if first {
+		if t.config.OnShutdown != nil {
+			t.config.OnShutdown()
+		}
+		close(t.doneChan())
+	}
+	return errs
+}
+
+// Done returns a channel that is closed once the tunnel has been shut down
+// and the connections to the hops have been closed.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.doneChan()
+}
+
+func (t *Tunnel) doneChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	return t.done
+}
+
+// closeAgent closes the connection to the ssh-agent, if we have one.
+func (t *Tunnel) closeAgent() {
+	if t.agentConn != nil {
+		t.agentConn.Close()
+	}
+}
+
+// closeClients closes the clients of a chain, starting with the innermost ssh
+// connection and working our way outward.
+func (t *Tunnel) closeClients(clients []*ssh.Client) error {
 	var errs error
 
-	// start with the innermost ssh connection and work our way outward.
-	for i := len(t.hops) - 1; i >= 0; i-- {
-		if t.hops[i].sshClient == nil {
+	for i := len(clients) - 1; i >= 0; i-- {
+		err := clients[i].Close()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%w: hop %d [%s]", ErrClosingHop, i, t.hops[i]))
+		}
+	}
+	return errs
+}
+
+// dialSerial tries each address in turn until we are able to connect to one of
+// them.
+func dialSerial(ctx context.Context, sshDialer sshDialerFunc, addrs []string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, string, error) {
+	var errs error
+
+	for _, addr := range addrs {
+		client, err := dialAddr(ctx, sshDialer, addr, config, timeout)
+		if err == nil {
+			return client, addr, nil
+		}
+		errs = errors.Join(errs, fmt.Errorf("[%s]: %w", addr, err))
+	}
+	return nil, "", errs
+}
+
+// dialParallel dials the addresses concurrently, starting a new attempt every
+// parallelDialStagger.  The first client to connect is returned and the other
+// attempts, whether they have started or not, are cancelled.  Clients that
+// manage to connect anyway are closed.  timeout, if non-zero, bounds the
+// whole race rather than each attempt.
+func dialParallel(ctx context.Context, sshDialer sshDialerFunc, addrs []string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, string, error) {
+	type result struct {
+		client *ssh.Client
+		addr   string
+		err    error
+	}
+
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	results := make(chan result, len(addrs))
+
+	for i, addr := range addrs {
+		go func(delay time.Duration, addr string) {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				results <- result{err: fmt.Errorf("[%s]: %w", addr, ctx.Err())}
+				return
+			}
+
+			client, err := sshDialer(ctx, "tcp", addr, config)
+			if err != nil {
+				err = fmt.Errorf("[%s]: %w", addr, err)
+			}
+			results <- result{client: client, addr: addr, err: err}
+		}(time.Duration(i)*parallelDialStagger, addr)
+	}
+
+	var errs error
+	for n := range addrs {
+		r := <-results
+		if r.err != nil {
+			errs = errors.Join(errs, r.err)
 			continue
 		}
 
-		err := t.hops[i].sshClient.Close()
+		cancel()
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if r := <-results; r.client != nil {
+					r.client.Close()
+				}
+			}
+		}(len(addrs) - n - 1)
+
+		return r.client, r.addr, nil
+	}
+	return nil, "", errs
+}
+
+// dialAddr makes a single attempt at connecting to a hop, bounded by timeout
+// if it is non-zero.
+func dialAddr(ctx context.Context, sshDialer sshDialerFunc, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return sshDialer(ctx, "tcp", addr, config)
+}
+
+// sshDial connects directly to addr and sets up an SSH client on the connection.
+// Each attempt, including each retry of the network dial, is bounded by
+// HopTimeout once it holds a ConnectLimiter slot, and the slot is given back
+// before we back off for a retry.
+func (t *Tunnel) sshDial(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if t.config.FirstHopNetwork != "" {
+		network = t.config.FirstHopNetwork
+	}
+
+	dial := t.config.FirstHopDialer
+	if dial == nil {
+		dialer := &net.Dialer{
+			Resolver: t.config.Resolver,
+		}
+		if t.config.LocalAddr != nil {
+			dialer.LocalAddr = t.config.LocalAddr
+		}
+		if t.config.TCPKeepAlive > 0 {
+			dialer.KeepAlive = t.config.TCPKeepAlive
+		}
+		dial = dialer.DialContext
+	}
+
+	backoff := t.config.FirstHopBackoff
+	for retry := 0; ; retry++ {
+		client, dialErr, err := t.sshDialAttempt(ctx, dial, network, addr, config)
+		if !dialErr {
+			return client, err
+		}
+
+		if retry == t.config.FirstHopRetries {
+			return nil, fmt.Errorf("%w: %w", ErrHostUnreachable, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff = min(2*backoff, maxFirstHopBackoff)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrHostUnreachable, err)
+		}
+	}
+}
+
+// sshDialAttempt makes a single attempt at connecting to the first hop for
+// sshDial.  dialErr is true if the network dial failed, which is the only
+// failure we retry.
+func (t *Tunnel) sshDialAttempt(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network, addr string, config *ssh.ClientConfig) (client *ssh.Client, dialErr bool, err error) {
+	if t.config.ConnectLimiter != nil {
+		err := t.config.ConnectLimiter.acquire(ctx)
 		if err != nil {
-			errs = errors.Join(errs,
-				fmt.Errorf("%w: hop %d [%s@%s:%d]", ErrClosingHop, i, t.hops[i].username, t.hops[i].host, t.hops[i].port))
+			return nil, false, err
 		}
+		defer t.config.ConnectLimiter.release()
 	}
-	return errs
+
+	if t.config.HopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.config.HopTimeout)
+		defer cancel()
+	}
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// net.Dialer already uses TCPKeepAlive, a FirstHopDialer conn needs it set
+	if t.config.FirstHopDialer != nil && t.config.TCPKeepAlive > 0 {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(t.config.TCPKeepAlive)
+		}
+	}
+
+	client, err = newClient(ctx, conn, addr, config)
+	return client, false, err
+}
+
+// hopDialer returns the SSH dialer for connecting to hop i from client, the
+// client for the hop before it.
+func (t *Tunnel) hopDialer(client *ssh.Client, i int) sshDialerFunc {
+	if t.hops[i].ProxyCommand != "" {
+		return proxyCommandDialer(client, t.hops[i].ProxyCommand)
+	}
+	return sshDialerFromClient(client)
 }
 
 // sshDialerFromClient creates a new SSH dialer given a client.
 func sshDialerFromClient(client *ssh.Client) sshDialerFunc {
-	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
-		conn, err := client.Dial(network, addr)
+	return func(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		conn, err := dialClient(ctx, client, network, addr)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrHostUnreachable, err)
 		}
+		return newClient(ctx, conn, addr, config)
+	}
+}
 
-		ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
-		if err != nil {
-			return nil, err
+// dialClient dials addr from client.  x/crypto/ssh does not take a context
+// when dialing, so if ctx is done before the dial completes we return
+// ctx.Err() and close the connection once the dial returns.
+func dialClient(ctx context.Context, client *ssh.Client, n string, addr string) (net.Conn, error) {
+	return dialWithContext(ctx, func() (net.Conn, error) {
+		return client.Dial(n, addr)
+	})
+}
+
+// dialWithContext runs dial, returning ctx.Err() if ctx is done before dial
+// returns.  If that happens the connection is closed once dial returns.
+func dialWithContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	if ctx.Done() == nil {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		results <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.conn, r.err
+
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// newClient performs the SSH handshake over conn.  Authentication failures are
+// wrapped in ErrAuthFailed.  If ctx is done before the handshake completes conn
+// is closed to abort it.
+func newClient(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if err == nil {
+			ncc.Close()
 		}
+		return nil, fmt.Errorf("ssh handshake: %w", ctx.Err())
+	}
+	if err != nil {
+		if isAuthError(err) {
+			return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		}
+		return nil, err
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
 
-		return ssh.NewClient(ncc, chans, reqs), nil
+// checkNetwork returns ErrUnsupportedNetwork if n is not a network that
+// ssh.Client.Dial understands.
+func checkNetwork(n string) error {
+	switch n {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return nil
 	}
+	return fmt.Errorf("%w: [%s], must be one of tcp, tcp4, tcp6 or unix", ErrUnsupportedNetwork, n)
+}
+
+// isForwardDenied reports whether err comes from the server refusing a
+// tcpip-forward or streamlocal-forward request.  Like isAuthError we have to
+// look at the message.
+func isForwardDenied(err error) bool {
+	return strings.Contains(err.Error(), "request denied by peer")
+}
+
+// isAuthError reports whether err comes from the SSH client running out of
+// authentication methods.  x/crypto/ssh has no sentinel for this so we have
+// to look at the message.
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
 }
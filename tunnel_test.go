@@ -0,0 +1,242 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialWithContextAbandonsBlockedDial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	unblock := make(chan struct{})
+	dial := func() (net.Conn, error) {
+		<-unblock
+		return local, nil
+	}
+
+	start := time.Now()
+	conn, err := dialWithContext(ctx, dial)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got conn=%v err=%v", conn, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dialWithContext returned after %v, should return when ctx is done", elapsed)
+	}
+
+	// once the dial completes the connection nobody is waiting for must be closed
+	close(unblock)
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = remote.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the abandoned connection to be closed, got %v", err)
+	}
+}
+
+func TestDialWithContextReturnsDialResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn, err := dialWithContext(ctx, func() (net.Conn, error) { return local, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != local {
+		t.Fatalf("expected the dialed connection to be returned")
+	}
+	conn.Close()
+}
+
+func TestClosedTunnel(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		Hops: []string{newTestServer(t, nil), newTestServer(t, nil)},
+	})
+	ctx := context.Background()
+
+	// make sure the tunnel worked so ErrClosed is down to Shutdown
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	conn, err := tun.DialContext(ctx, "tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	err = tun.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"DialContext", func() error {
+			_, err := tun.DialContext(ctx, "tcp", "127.0.0.1:80")
+			return err
+		}},
+		{"DialFromHop", func() error {
+			_, err := tun.DialFromHop(ctx, 0, "tcp", "127.0.0.1:80")
+			return err
+		}},
+		{"DialWithOrigin", func() error {
+			_, err := tun.DialWithOrigin(ctx, "tcp", "127.0.0.1:80", "192.0.2.1", 4711)
+			return err
+		}},
+		{"ListenContext", func() error {
+			_, err := tun.ListenContext(ctx, "tcp", "127.0.0.1:0")
+			return err
+		}},
+		{"Shell", func() error {
+			return tun.Shell(ctx, nil, io.Discard, io.Discard, nil)
+		}},
+		{"ServeRemote", func() error {
+			return tun.ServeRemote(ctx, "tcp", "127.0.0.1:0", func(net.Conn) {})
+		}},
+		{"Reset", tun.Reset},
+		{"Dial", func() error {
+			_, err := tun.Dial("tcp", "127.0.0.1:80")
+			return err
+		}},
+		{"Listen", func() error {
+			_, err := tun.Listen("tcp", "127.0.0.1:0")
+			return err
+		}},
+		{"CanReach", func() error {
+			return tun.CanReach(ctx, "tcp", "127.0.0.1:80")
+		}},
+		{"DialVerified", func() error {
+			_, err := tun.DialVerified(ctx, "tcp", "127.0.0.1:80", time.Millisecond)
+			return err
+		}},
+		{"DialTLS", func() error {
+			_, err := tun.DialTLS(ctx, "tcp", "127.0.0.1:443", nil)
+			return err
+		}},
+		{"ConnectStdio", func() error {
+			return tun.ConnectStdio(ctx, "tcp", "127.0.0.1:80", strings.NewReader(""), io.Discard)
+		}},
+		{"RemoteProxy", func() error {
+			return tun.RemoteProxy(ctx, "127.0.0.1:0", "127.0.0.1:80")
+		}},
+		{"ForwardUDP", func() error {
+			return tun.ForwardUDP(ctx, "127.0.0.1:0", "127.0.0.1:53")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if !errors.Is(err, ErrClosed) {
+				t.Fatalf("expected ErrClosed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClosedTunnelReason(t *testing.T) {
+	tun := newTestTunnel(t, Config{Hops: []string{newTestServer(t, nil)}})
+
+	reason := errors.New("maintenance")
+	tun.ShutdownWithError(reason)
+
+	_, err := tun.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	if !errors.Is(err, ErrClosed) || !errors.Is(err, reason) {
+		t.Fatalf("expected an error wrapping ErrClosed and the reason, got %v", err)
+	}
+}
+
+func TestShutdownAbortsStalledFirstHopDial(t *testing.T) {
+	var (
+		d       net.Dialer
+		dials   atomic.Int32
+		stalled = make(chan struct{})
+	)
+
+	tun := newTestTunnel(t, Config{
+		Hops: []string{newTestServer(t, nil)},
+		FirstHopDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			switch dials.Add(1) {
+			case 1:
+				return d.DialContext(ctx, network, addr)
+			case 2:
+				close(stalled)
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	reset := make(chan error, 1)
+	go func() { reset <- tun.Reset() }()
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset never dialed the first hop")
+	}
+	tun.Shutdown()
+
+	select {
+	case err := <-reset:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reset did not return promptly after Shutdown")
+	}
+}
+
+func TestHopTimeoutBoundsAuth(t *testing.T) {
+	release := make(chan struct{})
+
+	hop := newTestServer(t, func(c *ssh.ServerConfig) {
+		c.PublicKeyCallback = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-release:
+			}
+			return nil, nil
+		}
+	})
+	t.Cleanup(func() { close(release) })
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	start := time.Now()
+	tun, err := Create(Config{
+		Hops:       []string{hop},
+		Signers:    []ssh.Signer{newSigner(t)},
+		HopTimeout: 200 * time.Millisecond,
+	})
+	if err == nil {
+		tun.Shutdown()
+		t.Fatal("expected Create to time out while the server delays auth")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Create returned after %v, HopTimeout should bound auth", elapsed)
+	}
+
+	var hopErr *HopError
+	if !errors.As(err, &hopErr) || hopErr.Index != 0 {
+		t.Fatalf("expected a HopError for hop 0, got %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errors
+var (
+	ErrDatagramTooLarge = errors.New("datagram too large")
+)
+
+const (
+	// maxDatagram is the largest datagram the two byte length prefix can frame.
+	maxDatagram = 1<<16 - 1
+
+	// udpIdleTimeout is how long a UDP association lives without traffic in
+	// either direction before we close its stream.
+	udpIdleTimeout = 2 * time.Minute
+)
+
+// ForwardUDP listens for UDP datagrams on laddr and relays them through the
+// tunnel to raddr, which must be a ServeUDPRelay listener reachable from the
+// last hop.  SSH can only forward streams, so each datagram is sent over a TCP
+// connection prefixed by its length as a two byte big-endian integer, and
+// replies are framed the same way.
+//
+// Every local source address gets its own connection through the tunnel,
+// which is closed after udpIdleTimeout without traffic.  ForwardUDP returns
+// ctx.Err() when ctx is done and ErrClosed when the tunnel is shut down, after
+// closing the connections and waiting for their goroutines to return.
+func (t *Tunnel) ForwardUDP(ctx context.Context, laddr, raddr string) error {
+	var lc net.ListenConfig
+
+	pc, err := lc.ListenPacket(ctx, "udp", laddr)
+	if err != nil {
+		return err
+	}
+	return t.forwardUDP(ctx, pc, raddr)
+}
+
+// udpAssociation is the connection through the tunnel for one local source
+// address.
+type udpAssociation struct {
+	conn net.Conn
+	idle *time.Timer
+}
+
+func (t *Tunnel) forwardUDP(parent context.Context, pc net.PacketConn, raddr string) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	stopTunnel := context.AfterFunc(t.ctx, cancel)
+	defer stopTunnel()
+
+	stopConn := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stopConn()
+	defer pc.Close()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		assocs = map[string]*udpAssociation{}
+	)
+
+	defer func() {
+		mu.Lock()
+		for _, a := range assocs {
+			a.conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	buf := make([]byte, maxDatagram)
+
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			if t.ctx.Err() != nil {
+				t.mu.Lock()
+				defer t.mu.Unlock()
+				return t.errClosed()
+			}
+			return err
+		}
+
+		key := src.String()
+
+		mu.Lock()
+		a := assocs[key]
+		mu.Unlock()
+
+		if a == nil {
+			conn, err := t.DialContext(ctx, "tcp", raddr)
+			if err != nil {
+				if errors.Is(err, ErrClosed) {
+					return err
+				}
+				// drop the datagram like a UDP network would, the sender
+				// will retry if it cares
+				continue
+			}
+
+			a = &udpAssociation{
+				conn: conn,
+				idle: time.AfterFunc(udpIdleTimeout, func() { conn.Close() }),
+			}
+
+			mu.Lock()
+			assocs[key] = a
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					a.idle.Stop()
+					mu.Lock()
+					if assocs[key] == a {
+						delete(assocs, key)
+					}
+					mu.Unlock()
+					a.conn.Close()
+				}()
+
+				reply := make([]byte, maxDatagram)
+				for {
+					p, err := readDatagram(a.conn, reply)
+					if err != nil {
+						return
+					}
+					a.idle.Reset(udpIdleTimeout)
+
+					_, err = pc.WriteTo(p, src)
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+
+		a.idle.Reset(udpIdleTimeout)
+
+		err = writeDatagram(a.conn, buf[:n])
+		if err != nil {
+			// the reply goroutine removes the association once the
+			// connection is closed
+			a.conn.Close()
+		}
+	}
+}
+
+// ServeUDPRelay is the far end of ForwardUDP.  It accepts connections on ln,
+// which should be reachable from the last hop of the tunnel, and for each of
+// them sends the framed datagrams it reads to target over UDP and frames the
+// replies back.  Run it in a small program on the remote side, eg.
+//
+//	ln, err := net.Listen("tcp", "127.0.0.1:5353")
+//	...
+//	err = tunnel.ServeUDPRelay(ctx, ln, "127.0.0.1:53")
+//
+// ServeUDPRelay closes ln and returns ctx.Err() when ctx is done, or the error
+// from Accept.  Before returning it closes the connections that are still
+// open and waits for their goroutines to return.
+func ServeUDPRelay(ctx context.Context, ln net.Listener, target string) error {
+	cl := newContextListener(ctx, ln)
+	defer cl.Close()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = map[net.Conn]struct{}{}
+	)
+
+	defer func() {
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	var dialer net.Dialer
+
+	for {
+		conn, err := cl.Accept()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+
+			udp, err := dialer.DialContext(ctx, "udp", target)
+			if err != nil {
+				return
+			}
+			relayDatagrams(conn, udp)
+		}()
+	}
+}
+
+// relayDatagrams copies framed datagrams from stream to udp and datagrams from
+// udp framed to stream until either fails, and then closes both.
+func relayDatagrams(stream, udp net.Conn) {
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer udp.Close()
+		defer stream.Close()
+
+		buf := make([]byte, maxDatagram)
+		for {
+			p, err := readDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			_, err = udp.Write(p)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer udp.Close()
+		defer stream.Close()
+
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			err = writeDatagram(stream, buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+// writeDatagram writes p to w prefixed by its length.
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagram {
+		return fmt.Errorf("%w: %d bytes", ErrDatagramTooLarge, len(p))
+	}
+
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a datagram written by writeDatagram from r into buf,
+// which must be able to hold maxDatagram bytes.
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint16(size[:])
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
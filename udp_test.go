@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var stream bytes.Buffer
+
+	for _, p := range [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{'x'}, maxDatagram)} {
+		if err := writeDatagram(&stream, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, maxDatagram)
+	for _, want := range []int{5, 0, maxDatagram} {
+		p, err := readDatagram(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != want {
+			t.Fatalf("expected a datagram of %d bytes, got %d", want, len(p))
+		}
+	}
+
+	err := writeDatagram(&stream, make([]byte, maxDatagram+1))
+	if !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("expected ErrDatagramTooLarge, got %v", err)
+	}
+}
+
+func TestServeUDPRelay(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() { served <- ServeUDPRelay(ctx, ln, echo.LocalAddr().String()) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, msg := range []string{"ping", "pong"} {
+		if err := writeDatagram(conn, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := readDatagram(conn, make([]byte, maxDatagram))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != msg {
+			t.Fatalf("expected %q back, got %q", msg, p)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeUDPRelay did not return after ctx was cancelled")
+	}
+}
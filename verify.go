@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// errors
+var (
+	// ErrBackendClosed indicates that the service we dialed closed the
+	// connection right after the channel to it was opened.
+	ErrBackendClosed = errors.New("connection closed by backend")
+)
+
+// DialVerified dials addr like DialContext and then waits up to wait to see if
+// the service on the other end closes the connection right away.  Opening the
+// channel only tells us that the last hop was able to connect, so a service
+// that accepts and then immediately resets the connection would otherwise
+// look like a success.  If the connection is closed within wait we return
+// ErrBackendClosed.
+//
+// Anything the service sends while we wait is not lost, it is returned by the
+// first Read on the connection.
+func (t *Tunnel) DialVerified(ctx context.Context, network, addr string, wait time.Duration) (net.Conn, error) {
+	conn, _, err := t.DialContextTraced(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := conn.(*tunnelConn)
+
+	first := make(chan readResult, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, err := tc.Read(buf)
+		first <- readResult{buf: buf[:n], err: err}
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case r := <-first:
+		if len(r.buf) == 0 {
+			conn.Close()
+			return nil, fmt.Errorf("%w [%s]: %v", ErrBackendClosed, addr, r.err)
+		}
+		first <- r
+		return &verifiedConn{tunnelConn: tc, first: first}, nil
+
+	case <-timer.C:
+		return &verifiedConn{tunnelConn: tc, first: first}, nil
+
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+// verifiedConn is a tunnelConn that has a read in flight from DialVerified.
+// The result of that read is returned before we read from the connection
+// again.
+type verifiedConn struct {
+	*tunnelConn
+
+	mu         sync.Mutex
+	first      chan readResult
+	pending    []byte
+	pendingErr error
+}
+
+func (c *verifiedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.first != nil {
+		r := <-c.first
+		c.first = nil
+		c.pending, c.pendingErr = r.buf, r.err
+	}
+
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if c.pendingErr != nil {
+		err := c.pendingErr
+		c.pendingErr = nil
+		return 0, err
+	}
+	return c.tunnelConn.Read(b)
+}